@@ -2,6 +2,10 @@ package config
 
 import (
 	"bytes"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
@@ -94,9 +98,33 @@ func TestServerOptionsDefauleValue(t *testing.T) {
 		}
 	})
 
+	t.Run("allowedOrigins", func(t *testing.T) {
+		if allowedOrigins := opts.AllowedOrigins(); opts.GetRawAllowedOrigins() == nil && allowedOrigins != nil {
+			t.Fatalf(`*ServerOptions.AllowedOrigins() = %v, want match for nil`, allowedOrigins)
+		}
+	})
+
+	t.Run("writeTimeout", func(t *testing.T) {
+		if writeTimeout := opts.WriteTimeout(); opts.GetRawWriteTimeout() == nil && writeTimeout != 10000*time.Millisecond {
+			t.Fatalf(`*ServerOptions.WriteTimeout() = %d, want match for %d`, writeTimeout, 10000*time.Millisecond)
+		}
+	})
+
+	t.Run("maxStall", func(t *testing.T) {
+		if maxStall := opts.MaxStall(); opts.GetRawMaxStall() == nil && maxStall != 0 {
+			t.Fatalf(`*ServerOptions.MaxStall() = %d, want match for %d`, maxStall, 0)
+		}
+	})
+
+	t.Run("trustedProxies", func(t *testing.T) {
+		if trustedProxies := opts.TrustedProxies(); opts.GetRawTrustedProxies() == nil && trustedProxies != nil {
+			t.Fatalf(`*ServerOptions.TrustedProxies() = %v, want match for nil`, trustedProxies)
+		}
+	})
+
 	t.Run("transports", func(t *testing.T) {
-		if transports := opts.Transports(); opts.GetRawTransports() == nil && transports != nil && !transports.Has("websocket") {
-			t.Fatalf(`*ServerOptions.Transports() = %s, want match for ["websocket")]`, transports.Keys())
+		if transports := opts.Transports(); opts.GetRawTransports() == nil && transports != nil && !(transports.Has("polling") && transports.Has("websocket")) {
+			t.Fatalf(`*ServerOptions.Transports() = %s, want match for ["polling", "websocket")]`, transports.Keys())
 		}
 	})
 
@@ -112,18 +140,54 @@ func TestServerOptionsDefauleValue(t *testing.T) {
 		}
 	})
 
+	t.Run("webSocketUpgrader", func(t *testing.T) {
+		if upgrader := opts.WebSocketUpgrader(); opts.GetRawWebSocketUpgrader() == nil && (upgrader.ReadBufferSize != 1024 || upgrader.WriteBufferSize != 1024) {
+			t.Fatalf(`*ServerOptions.WebSocketUpgrader() = %+v, want match for 1024 bytes buffers`, upgrader)
+		}
+	})
+
 	t.Run("httpCompression/threshold", func(t *testing.T) {
 		if httpCompression := opts.HttpCompression(); opts.GetRawHttpCompression() == nil && httpCompression != nil && httpCompression.Threshold != 1024 {
 			t.Fatalf(`*ServerOptions.HttpCompression().Threshold = %d, want match for %d`, httpCompression.Threshold, 1024)
 		}
 	})
 
+	t.Run("httpCompressionLevels", func(t *testing.T) {
+		if httpCompressionLevels := opts.HttpCompressionLevels(); opts.GetRawHttpCompressionLevels() == nil && httpCompressionLevels != nil && (httpCompressionLevels.GzipLevel() != 1 || httpCompressionLevels.DeflateLevel() != 1 || httpCompressionLevels.BrotliLevel() != 1) {
+			t.Fatalf(`*ServerOptions.HttpCompressionLevels() = %+v, want match for level 1 of each content-coding`, httpCompressionLevels)
+		}
+	})
+
+	t.Run("connectionStateRecovery", func(t *testing.T) {
+		if connectionStateRecovery := opts.ConnectionStateRecovery(); opts.GetRawConnectionStateRecovery() == nil && connectionStateRecovery != nil {
+			t.Fatalf(`*ServerOptions.ConnectionStateRecovery() = %v, want match for nil`, connectionStateRecovery)
+		}
+	})
+
+	t.Run("writeBuffer", func(t *testing.T) {
+		if writeBuffer := opts.WriteBuffer(); opts.GetRawWriteBuffer() == nil && writeBuffer != nil {
+			t.Fatalf(`*ServerOptions.WriteBuffer() = %v, want match for nil`, writeBuffer)
+		}
+	})
+
 	t.Run("initialPacket", func(t *testing.T) {
 		if initialPacket := opts.InitialPacket(); opts.GetRawInitialPacket() == nil && initialPacket != nil {
 			t.Fatalf(`*ServerOptions.InitialPacket() = %v, want match for nil`, initialPacket)
 		}
 	})
 
+	t.Run("initialPacketFunc", func(t *testing.T) {
+		if initialPacketFunc := opts.InitialPacketFunc(); opts.GetRawInitialPacketFunc() == nil && initialPacketFunc != nil {
+			t.Fatalf(`*ServerOptions.InitialPacketFunc() = %v, want match for nil`, initialPacketFunc)
+		}
+	})
+
+	t.Run("logger", func(t *testing.T) {
+		if logger := opts.Logger(); opts.GetRawLogger() == nil && logger != nil {
+			t.Fatalf(`*ServerOptions.Logger() = %v, want match for nil`, logger)
+		}
+	})
+
 	t.Run("cookie", func(t *testing.T) {
 		if cookie := opts.Cookie(); opts.GetRawCookie() == nil && cookie != nil {
 			t.Fatalf(`*ServerOptions.Cookie() = %v, want match for nil`, cookie)
@@ -181,6 +245,35 @@ func TestServerOptionsSetValue(t *testing.T) {
 		}
 	})
 
+	t.Run("allowedOrigins", func(t *testing.T) {
+		opts.SetAllowedOrigins([]string{"https://*.example.com"})
+		if allowedOrigins, ok := opts.AllowedOrigins().([]string); !ok || len(allowedOrigins) != 1 || allowedOrigins[0] != "https://*.example.com" {
+			t.Fatalf(`*ServerOptions.AllowedOrigins() = %v, want match for %v`, opts.AllowedOrigins(), []string{"https://*.example.com"})
+		}
+	})
+
+	t.Run("writeTimeout", func(t *testing.T) {
+		opts.SetWriteTimeout(5 * time.Second)
+		if writeTimeout := opts.WriteTimeout(); writeTimeout != 5*time.Second {
+			t.Fatalf(`*ServerOptions.WriteTimeout() = %d, want match for %d`, writeTimeout, 5*time.Second)
+		}
+	})
+
+	t.Run("maxStall", func(t *testing.T) {
+		opts.SetMaxStall(30 * time.Second)
+		if maxStall := opts.MaxStall(); maxStall != 30*time.Second {
+			t.Fatalf(`*ServerOptions.MaxStall() = %d, want match for %d`, maxStall, 30*time.Second)
+		}
+	})
+
+	t.Run("trustedProxies", func(t *testing.T) {
+		input := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+		opts.SetTrustedProxies(input)
+		if trustedProxies := opts.TrustedProxies(); len(trustedProxies) != 1 || trustedProxies[0] != input[0] {
+			t.Fatalf(`*ServerOptions.TrustedProxies() = %v, want match for %v`, trustedProxies, input)
+		}
+	})
+
 	t.Run("transports", func(t *testing.T) {
 		opts.SetTransports(_types.NewSet("websocket", "polling"))
 		if transports := opts.Transports(); transports != nil && !(transports.Has("polling") && transports.Has("websocket")) {
@@ -203,6 +296,14 @@ func TestServerOptionsSetValue(t *testing.T) {
 		}
 	})
 
+	t.Run("webSocketUpgrader", func(t *testing.T) {
+		input := &types.WebSocketUpgrader{Subprotocols: []string{"chat"}, CompressionLevel: 9}
+		opts.SetWebSocketUpgrader(input)
+		if upgrader := opts.WebSocketUpgrader(); upgrader != input {
+			t.Fatalf(`*ServerOptions.WebSocketUpgrader() = %+v, want match for %+v`, upgrader, input)
+		}
+	})
+
 	t.Run("httpCompression/threshold", func(t *testing.T) {
 		input := &_types.HttpCompression{Threshold: 2048}
 		opts.SetHttpCompression(input)
@@ -211,6 +312,53 @@ func TestServerOptionsSetValue(t *testing.T) {
 		}
 	})
 
+	t.Run("httpCompressionLevels", func(t *testing.T) {
+		input := &types.HttpCompressionLevels{Gzip: types.CompressionLevel(6), Deflate: types.CompressionLevel(9), Brotli: types.CompressionLevel(0)}
+		opts.SetHttpCompressionLevels(input)
+		if httpCompressionLevels := opts.HttpCompressionLevels(); httpCompressionLevels != input || httpCompressionLevels.BrotliLevel() != 0 {
+			t.Fatalf(`*ServerOptions.HttpCompressionLevels() = %v, want match for %v`, httpCompressionLevels, input)
+		}
+
+		// the levels which are not set are the default ones
+		if levels := (&types.HttpCompressionLevels{Gzip: types.CompressionLevel(0)}); levels.GzipLevel() != 0 || levels.DeflateLevel() != types.DefaultCompressionLevel {
+			t.Fatalf(`GzipLevel(), DeflateLevel() = %d, %d, want match for 0, %d`, levels.GzipLevel(), levels.DeflateLevel(), types.DefaultCompressionLevel)
+		}
+	})
+
+	t.Run("httpCompressionLevels/invalid", func(t *testing.T) {
+		for _, input := range []*types.HttpCompressionLevels{
+			{Gzip: types.CompressionLevel(10)},
+			{Deflate: types.CompressionLevel(-3)},
+			{Brotli: types.CompressionLevel(12)},
+			{Brotli: types.CompressionLevel(-1)},
+		} {
+			func() {
+				defer func() {
+					if err, ok := recover().(error); !ok || !strings.Contains(err.Error(), "invalid compression level") {
+						t.Fatalf(`*ServerOptions.SetHttpCompressionLevels(%+v) panic = %v, want match for an invalid compression level`, input, err)
+					}
+				}()
+				opts.SetHttpCompressionLevels(input)
+			}()
+		}
+	})
+
+	t.Run("connectionStateRecovery", func(t *testing.T) {
+		input := &types.ConnectionStateRecovery{MaxDisconnectionDuration: 30 * time.Second, MaxBufferedPackets: 100}
+		opts.SetConnectionStateRecovery(input)
+		if connectionStateRecovery := opts.ConnectionStateRecovery(); connectionStateRecovery != input {
+			t.Fatalf(`*ServerOptions.ConnectionStateRecovery() = %v, want match for %v`, connectionStateRecovery, input)
+		}
+	})
+
+	t.Run("writeBuffer", func(t *testing.T) {
+		input := &types.WriteBuffer{MaxPackets: 10, MaxBytes: 1024, Policy: types.WriteBufferBlock, Timeout: time.Second}
+		opts.SetWriteBuffer(input)
+		if writeBuffer := opts.WriteBuffer(); writeBuffer != input {
+			t.Fatalf(`*ServerOptions.WriteBuffer() = %v, want match for %v`, writeBuffer, input)
+		}
+	})
+
 	t.Run("initialPacket", func(t *testing.T) {
 		input := bytes.NewBuffer([]byte{1})
 		opts.SetInitialPacket(input)
@@ -219,6 +367,23 @@ func TestServerOptionsSetValue(t *testing.T) {
 		}
 	})
 
+	t.Run("initialPacketFunc", func(t *testing.T) {
+		opts.SetInitialPacketFunc(func(*types.HttpContext) (io.Reader, error) {
+			return bytes.NewBuffer([]byte{1}), nil
+		})
+		if initialPacketFunc := opts.InitialPacketFunc(); initialPacketFunc == nil {
+			t.Fatalf(`*ServerOptions.InitialPacketFunc() = nil, want match for a function`)
+		}
+	})
+
+	t.Run("logger", func(t *testing.T) {
+		input := slog.New(slog.NewTextHandler(io.Discard, nil))
+		opts.SetLogger(input)
+		if logger := opts.Logger(); logger != input {
+			t.Fatalf(`*ServerOptions.Logger() = %v, want match for %v`, logger, input)
+		}
+	})
+
 	t.Run("cookie", func(t *testing.T) {
 		input := &fasthttp.Cookie{}
 		input.SetKey("Test")
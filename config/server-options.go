@@ -2,6 +2,8 @@ package config
 
 import (
 	"io"
+	"log/slog"
+	"net/netip"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -12,6 +14,9 @@ import (
 type (
 	AllowRequest func(*types.HttpContext) error
 
+	// Returns the data of the message packet sent right after the handshake packet to the client of the request.
+	InitialPacketFunc func(*types.HttpContext) (io.Reader, error)
+
 	ServerOptionsInterface interface {
 		SetPingTimeout(time.Duration)
 		GetRawPingTimeout() *time.Duration
@@ -25,6 +30,14 @@ type (
 		GetRawUpgradeTimeout() *time.Duration
 		UpgradeTimeout() time.Duration
 
+		SetWriteTimeout(time.Duration)
+		GetRawWriteTimeout() *time.Duration
+		WriteTimeout() time.Duration
+
+		SetMaxStall(time.Duration)
+		GetRawMaxStall() *time.Duration
+		MaxStall() time.Duration
+
 		SetMaxHttpBufferSize(int64)
 		GetRawMaxHttpBufferSize() *int64
 		MaxHttpBufferSize() int64
@@ -33,6 +46,14 @@ type (
 		GetRawAllowRequest() AllowRequest
 		AllowRequest() AllowRequest
 
+		SetAllowedOrigins(any)
+		GetRawAllowedOrigins() any
+		AllowedOrigins() any
+
+		SetTrustedProxies([]netip.Prefix)
+		GetRawTrustedProxies() []netip.Prefix
+		TrustedProxies() []netip.Prefix
+
 		SetTransports(*_types.Set[string])
 		GetRawTransports() *_types.Set[string]
 		Transports() *_types.Set[string]
@@ -45,14 +66,38 @@ type (
 		GetRawPerMessageDeflate() *_types.PerMessageDeflate
 		PerMessageDeflate() *_types.PerMessageDeflate
 
+		SetWebSocketUpgrader(*types.WebSocketUpgrader)
+		GetRawWebSocketUpgrader() *types.WebSocketUpgrader
+		WebSocketUpgrader() *types.WebSocketUpgrader
+
 		SetHttpCompression(*_types.HttpCompression)
 		GetRawHttpCompression() *_types.HttpCompression
 		HttpCompression() *_types.HttpCompression
 
+		SetHttpCompressionLevels(*types.HttpCompressionLevels)
+		GetRawHttpCompressionLevels() *types.HttpCompressionLevels
+		HttpCompressionLevels() *types.HttpCompressionLevels
+
+		SetConnectionStateRecovery(*types.ConnectionStateRecovery)
+		GetRawConnectionStateRecovery() *types.ConnectionStateRecovery
+		ConnectionStateRecovery() *types.ConnectionStateRecovery
+
+		SetWriteBuffer(*types.WriteBuffer)
+		GetRawWriteBuffer() *types.WriteBuffer
+		WriteBuffer() *types.WriteBuffer
+
 		SetInitialPacket(io.Reader)
 		GetRawInitialPacket() io.Reader
 		InitialPacket() io.Reader
 
+		SetInitialPacketFunc(InitialPacketFunc)
+		GetRawInitialPacketFunc() InitialPacketFunc
+		InitialPacketFunc() InitialPacketFunc
+
+		SetLogger(*slog.Logger)
+		GetRawLogger() *slog.Logger
+		Logger() *slog.Logger
+
 		SetCookie(*fasthttp.Cookie)
 		GetRawCookie() *fasthttp.Cookie
 		Cookie() *fasthttp.Cookie
@@ -76,6 +121,12 @@ type (
 		// how many ms before an uncompleted transport upgrade is cancelled
 		upgradeTimeout *time.Duration
 
+		// how long writing a websocket message may take before the client is considered gone
+		writeTimeout *time.Duration
+
+		// how long the packets queued to a websocket may wait to be written before the client is considered too slow
+		maxStall *time.Duration
+
 		// how many bytes or characters a message can be, before closing the session (to avoid DoS).
 		maxHttpBufferSize *int64
 
@@ -83,6 +134,12 @@ type (
 		// and can decide whether to continue. Returning an error indicates that the request was rejected.
 		allowRequest AllowRequest
 
+		// the origins allowed to send handshake, upgrade and polling requests, any origin being allowed if nil.
+		allowedOrigins any
+
+		// the networks of the proxies whose forwarding headers are trusted, none by default.
+		trustedProxies []netip.Prefix
+
 		// the low-level transports that are enabled
 		transports *_types.Set[string]
 
@@ -92,15 +149,33 @@ type (
 		// parameters of the WebSocket permessage-deflate extension (see ws module api docs). Set to false to disable.
 		perMessageDeflate *_types.PerMessageDeflate
 
+		// the settings of the websocket upgrades: buffer sizes, subprotocols, handshake timeout and compression level.
+		webSocketUpgrader *types.WebSocketUpgrader
+
 		// parameters of the http compression for the polling transports (see zlib api docs). Set to false to disable.
 		httpCompression *_types.HttpCompression
 
+		// the compression level of each content-coding (gzip, deflate, br) used by the http compression.
+		httpCompressionLevels *types.HttpCompressionLevels
+
+		// the connection state recovery, which retains the closed sessions for a while. Disabled by default.
+		connectionStateRecovery *types.ConnectionStateRecovery
+
+		// the limits of the packets buffered by each socket. Unbounded by default.
+		writeBuffer *types.WriteBuffer
+
 		// wsEngine is not supported
 		// wsEngine
 
 		// an optional packet which will be concatenated to the handshake packet emitted by Engine.IO.
 		initialPacket io.Reader
 
+		// an optional function which returns the packet concatenated to the handshake packet of each client.
+		initialPacketFunc InitialPacketFunc
+
+		// the logger receiving the structured records of the sessions lifecycle. Disabled by default.
+		logger *slog.Logger
+
 		// configuration of the cookie that contains the client sid to send as part of handshake response headers. This cookie
 		// might be used for sticky-session. Defaults to not sending any cookie.
 		cookie *fasthttp.Cookie
@@ -132,12 +207,24 @@ func (s *ServerOptions) Assign(data ServerOptionsInterface) ServerOptionsInterfa
 	if s.GetRawUpgradeTimeout() == nil {
 		s.SetUpgradeTimeout(data.UpgradeTimeout())
 	}
+	if s.GetRawWriteTimeout() == nil {
+		s.SetWriteTimeout(data.WriteTimeout())
+	}
+	if s.GetRawMaxStall() == nil {
+		s.SetMaxStall(data.MaxStall())
+	}
 	if s.GetRawMaxHttpBufferSize() == nil {
 		s.SetMaxHttpBufferSize(data.MaxHttpBufferSize())
 	}
 	if s.GetRawAllowRequest() == nil {
 		s.SetAllowRequest(data.AllowRequest())
 	}
+	if s.GetRawAllowedOrigins() == nil {
+		s.SetAllowedOrigins(data.AllowedOrigins())
+	}
+	if s.GetRawTrustedProxies() == nil {
+		s.SetTrustedProxies(data.TrustedProxies())
+	}
 	if s.GetRawTransports() == nil {
 		s.SetTransports(data.Transports())
 	}
@@ -147,12 +234,30 @@ func (s *ServerOptions) Assign(data ServerOptionsInterface) ServerOptionsInterfa
 	if s.GetRawPerMessageDeflate() == nil {
 		s.SetPerMessageDeflate(data.PerMessageDeflate())
 	}
+	if s.GetRawWebSocketUpgrader() == nil {
+		s.SetWebSocketUpgrader(data.WebSocketUpgrader())
+	}
 	if s.GetRawHttpCompression() == nil {
 		s.SetHttpCompression(data.HttpCompression())
 	}
+	if s.GetRawHttpCompressionLevels() == nil {
+		s.SetHttpCompressionLevels(data.HttpCompressionLevels())
+	}
+	if s.GetRawConnectionStateRecovery() == nil {
+		s.SetConnectionStateRecovery(data.ConnectionStateRecovery())
+	}
+	if s.GetRawWriteBuffer() == nil {
+		s.SetWriteBuffer(data.WriteBuffer())
+	}
 	if s.GetRawInitialPacket() == nil {
 		s.SetInitialPacket(data.InitialPacket())
 	}
+	if s.GetRawInitialPacketFunc() == nil {
+		s.SetInitialPacketFunc(data.InitialPacketFunc())
+	}
+	if s.GetRawLogger() == nil {
+		s.SetLogger(data.Logger())
+	}
 	if s.GetRawCookie() == nil {
 		s.SetCookie(data.Cookie())
 	}
@@ -212,6 +317,44 @@ func (s *ServerOptions) UpgradeTimeout() time.Duration {
 	return *s.upgradeTimeout
 }
 
+// how long writing a websocket message may take, e.g. to a half-open connection whose peer is gone. The session is
+// closed with the "write timeout" reason afterwards, rather than waiting for the heartbeat. Set to 0 to disable.
+// @default 10_000
+func (s *ServerOptions) SetWriteTimeout(writeTimeout time.Duration) {
+	s.writeTimeout = &writeTimeout
+}
+func (s *ServerOptions) GetRawWriteTimeout() *time.Duration {
+	return s.writeTimeout
+}
+func (s *ServerOptions) WriteTimeout() time.Duration {
+	if s.writeTimeout == nil {
+		return time.Duration(10_000 * time.Millisecond)
+	}
+	return *s.writeTimeout
+}
+
+// how long the packets queued to a websocket may wait to be written, e.g. by a client reading too slowly to keep up
+// with the messages while still acknowledging each write. The session is closed with the "write timeout" reason
+// afterwards. Set to 0 to disable.
+//
+//	opts := &ServerOptions{}
+//	opts.SetMaxStall(30 * time.Second)
+//	NewServer(opts)
+//
+// @default 0
+func (s *ServerOptions) SetMaxStall(maxStall time.Duration) {
+	s.maxStall = &maxStall
+}
+func (s *ServerOptions) GetRawMaxStall() *time.Duration {
+	return s.maxStall
+}
+func (s *ServerOptions) MaxStall() time.Duration {
+	if s.maxStall == nil {
+		return 0
+	}
+	return *s.maxStall
+}
+
 // how many bytes or characters a message can be, before closing the session (to avoid DoS).
 // @default 1e5 (100 KB)
 func (s *ServerOptions) SetMaxHttpBufferSize(maxHttpBufferSize int64) {
@@ -244,13 +387,55 @@ func (s *ServerOptions) AllowRequest() AllowRequest {
 	return s.allowRequest
 }
 
-// The low-level transports that are enabled.
+// the origins allowed to send requests, checked against the "Origin" header of the handshake, upgrade and polling
+// requests. The requests from another origin are rejected as FORBIDDEN, with the "ORIGIN_NOT_ALLOWED" name.
+// The requests without an "Origin" header, such as the same-origin polling requests or the non-browser ones, are allowed.
+//
+// Either one, or a slice ([]string or []any) of: an exact origin, an origin with "*" wildcards, a *regexp.Regexp,
+// a types.OriginFunc, or a bool. See types.IsOriginAllowed.
 //
 //	opts := &ServerOptions{}
-//	opts.SetTransports(types.NewSet("websocket"))
+//	opts.SetAllowedOrigins([]any{"https://example.com", "https://*.example.com", regexp.MustCompile(`^http://localhost:\d+$`)})
 //	NewServer(opts)
 //
-// @default ["websocket"]
+// @default nil
+func (s *ServerOptions) SetAllowedOrigins(allowedOrigins any) {
+	s.allowedOrigins = allowedOrigins
+}
+func (s *ServerOptions) GetRawAllowedOrigins() any {
+	return s.allowedOrigins
+}
+func (s *ServerOptions) AllowedOrigins() any {
+	return s.allowedOrigins
+}
+
+// the networks of the proxies in front of the server, such as load balancers. When the peer of a request belongs to
+// one of them, the client address is resolved from the "Forwarded", "X-Forwarded-For" or "X-Real-IP" header, see
+// types.ResolveRemoteAddress. The headers are ignored otherwise, as anyone can set them.
+//
+//	opts := &ServerOptions{}
+//	opts.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+//	NewServer(opts)
+//
+// @default nil
+func (s *ServerOptions) SetTrustedProxies(trustedProxies []netip.Prefix) {
+	s.trustedProxies = trustedProxies
+}
+func (s *ServerOptions) GetRawTrustedProxies() []netip.Prefix {
+	return s.trustedProxies
+}
+func (s *ServerOptions) TrustedProxies() []netip.Prefix {
+	return s.trustedProxies
+}
+
+// The low-level transports that are enabled, among "polling", "sse", "websocket", "webtransport"
+// and the ones added with transports.Register.
+//
+//	opts := &ServerOptions{}
+//	opts.SetTransports(types.NewSet("polling", "websocket"))
+//	NewServer(opts)
+//
+// @default ["polling", "websocket"]
 func (s *ServerOptions) SetTransports(transports *_types.Set[string]) {
 	s.transports = transports
 }
@@ -259,7 +444,7 @@ func (s *ServerOptions) GetRawTransports() *_types.Set[string] {
 }
 func (s *ServerOptions) Transports() *_types.Set[string] {
 	if s.transports == nil {
-		return _types.NewSet("websocket")
+		return _types.NewSet("polling", "websocket")
 	}
 	return s.transports
 }
@@ -291,6 +476,33 @@ func (s *ServerOptions) PerMessageDeflate() *_types.PerMessageDeflate {
 	return s.perMessageDeflate
 }
 
+// the settings of the websocket upgrades: the buffer sizes, a write buffer pool shared by the connections, the
+// negotiated subprotocols, the handshake timeout and the compression level of the permessage-deflate extension.
+//
+//	opts := &ServerOptions{}
+//	opts.SetWebSocketUpgrader(&types.WebSocketUpgrader{
+//		WriteBufferPool: &sync.Pool{},
+//		Subprotocols:    []string{"v2.chat.example.com", "chat.example.com"},
+//	})
+//	NewServer(opts)
+//
+// @default {ReadBufferSize: 1024, WriteBufferSize: 1024}
+func (s *ServerOptions) SetWebSocketUpgrader(webSocketUpgrader *types.WebSocketUpgrader) {
+	s.webSocketUpgrader = webSocketUpgrader
+}
+func (s *ServerOptions) GetRawWebSocketUpgrader() *types.WebSocketUpgrader {
+	return s.webSocketUpgrader
+}
+func (s *ServerOptions) WebSocketUpgrader() *types.WebSocketUpgrader {
+	if s.webSocketUpgrader == nil {
+		return &types.WebSocketUpgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		}
+	}
+	return s.webSocketUpgrader
+}
+
 // parameters of the http compression for the polling transports (see zlib api docs). Set to false to disable.
 // @default true
 func (s *ServerOptions) SetHttpCompression(httpCompression *_types.HttpCompression) {
@@ -308,7 +520,73 @@ func (s *ServerOptions) HttpCompression() *_types.HttpCompression {
 	return s.httpCompression
 }
 
+// the compression level of each content-coding (gzip, deflate, br) used by the http compression. It panics if a level
+// is out of the range of its algorithm, see types.HttpCompressionLevels.
+//
+//	opts := &ServerOptions{}
+//	opts.SetHttpCompressionLevels(&types.HttpCompressionLevels{Brotli: types.CompressionLevel(4)})
+//	NewServer(opts)
+//
+// @default {Gzip: 1, Deflate: 1, Brotli: 1}
+func (s *ServerOptions) SetHttpCompressionLevels(httpCompressionLevels *types.HttpCompressionLevels) {
+	if err := httpCompressionLevels.Validate(); err != nil {
+		panic(err)
+	}
+	s.httpCompressionLevels = httpCompressionLevels
+}
+func (s *ServerOptions) GetRawHttpCompressionLevels() *types.HttpCompressionLevels {
+	return s.httpCompressionLevels
+}
+func (s *ServerOptions) HttpCompressionLevels() *types.HttpCompressionLevels {
+	if s.httpCompressionLevels == nil {
+		return &types.HttpCompressionLevels{
+			Gzip:    types.CompressionLevel(types.DefaultCompressionLevel),
+			Deflate: types.CompressionLevel(types.DefaultCompressionLevel),
+			Brotli:  types.CompressionLevel(types.DefaultCompressionLevel),
+		}
+	}
+	return s.httpCompressionLevels
+}
+
+// the connection state recovery, which retains the sessions closed by a transport error, a transport close, a ping
+// timeout or a write timeout, so that a reconnecting client can resume them. Set to nil to disable.
+//
+//	opts := &ServerOptions{}
+//	opts.SetConnectionStateRecovery(&types.ConnectionStateRecovery{MaxDisconnectionDuration: 2 * time.Minute})
+//	NewServer(opts)
+//
+// @default nil
+func (s *ServerOptions) SetConnectionStateRecovery(connectionStateRecovery *types.ConnectionStateRecovery) {
+	s.connectionStateRecovery = connectionStateRecovery
+}
+func (s *ServerOptions) GetRawConnectionStateRecovery() *types.ConnectionStateRecovery {
+	return s.connectionStateRecovery
+}
+func (s *ServerOptions) ConnectionStateRecovery() *types.ConnectionStateRecovery {
+	return s.connectionStateRecovery
+}
+
+// the limits of the packets buffered by each socket while its transport is not writable, and what happens once they
+// are reached. The socket emits a "backpressure" event whenever a limit is hit. Set to nil to disable.
+//
+//	opts := &ServerOptions{}
+//	opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 1000, Policy: types.WriteBufferDropOldest})
+//	NewServer(opts)
+//
+// @default nil
+func (s *ServerOptions) SetWriteBuffer(writeBuffer *types.WriteBuffer) {
+	s.writeBuffer = writeBuffer
+}
+func (s *ServerOptions) GetRawWriteBuffer() *types.WriteBuffer {
+	return s.writeBuffer
+}
+func (s *ServerOptions) WriteBuffer() *types.WriteBuffer {
+	return s.writeBuffer
+}
+
 // an optional packet which will be concatenated to the handshake packet emitted by Engine.IO.
+// The reader is read once when the server is created, every client gets the same data.
+// It is ignored if an InitialPacketFunc is set.
 func (s *ServerOptions) SetInitialPacket(initialPacket io.Reader) {
 	s.initialPacket = initialPacket
 }
@@ -319,6 +597,43 @@ func (s *ServerOptions) InitialPacket() io.Reader {
 	return s.initialPacket
 }
 
+// an optional function which returns the packet concatenated to the handshake packet emitted by Engine.IO, it is
+// called for each new client. Returning a nil reader sends no packet, returning an error rejects the handshake.
+//
+//	opts := &ServerOptions{}
+//	opts.SetInitialPacketFunc(func(ctx *types.HttpContext) (io.Reader, error) {
+//		return strings.NewReader(`{"user":"` + ctx.Query().Peek("user") + `"}`), nil
+//	})
+//	NewServer(opts)
+func (s *ServerOptions) SetInitialPacketFunc(initialPacketFunc InitialPacketFunc) {
+	s.initialPacketFunc = initialPacketFunc
+}
+func (s *ServerOptions) GetRawInitialPacketFunc() InitialPacketFunc {
+	return s.initialPacketFunc
+}
+func (s *ServerOptions) InitialPacketFunc() InitialPacketFunc {
+	return s.initialPacketFunc
+}
+
+// the logger receiving the structured records of the sessions lifecycle: handshake, upgrade, close and the rejected
+// connections. The records carry the sid, transport, remote address and protocol of the session, or the error code of
+// the rejected connection. Set to nil to disable, the debug logs are not affected.
+//
+//	opts := &ServerOptions{}
+//	opts.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+//	NewServer(opts)
+//
+// @default nil
+func (s *ServerOptions) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+func (s *ServerOptions) GetRawLogger() *slog.Logger {
+	return s.logger
+}
+func (s *ServerOptions) Logger() *slog.Logger {
+	return s.logger
+}
+
 // configuration of the cookie that contains the client sid to send as part of handshake response headers. This cookie
 // might be used for sticky-session. Defaults to not sending any cookie.
 // @default false
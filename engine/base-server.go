@@ -1,10 +1,20 @@
 package engine
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io-go-parser/packet"
+	"github.com/zishang520/engine.io-go-parser/parser"
+	p_types "github.com/zishang520/engine.io-go-parser/types"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/transports"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
@@ -24,11 +34,15 @@ const (
 	BAD_REQUEST                  int = 3
 	FORBIDDEN                    int = 4
 	UNSUPPORTED_PROTOCOL_VERSION int = 5
+	SERVICE_UNAVAILABLE          int = 6
 )
 
 var (
 	server_log = log.NewLog("engine")
 
+	// The close reasons after which a session can be recovered.
+	recoverableReasons = _types.NewSet("transport error", "transport close", "ping timeout", "write timeout")
+
 	errorMessages map[int]string = map[int]string{
 		OK_REQUEST:                   `OK`,
 		UNKNOWN_TRANSPORT:            `Transport unknown`,
@@ -37,29 +51,44 @@ var (
 		BAD_REQUEST:                  `Bad request`,
 		FORBIDDEN:                    `Forbidden`,
 		UNSUPPORTED_PROTOCOL_VERSION: "Unsupported protocol version",
+		SERVICE_UNAVAILABLE:          "Server shutting down",
 	}
 )
 
+// A closed session which can be recovered until the timer expires.
+type disconnectedSocket struct {
+	socket Socket
+	timer  *utils.Timer
+}
+
 type baseServer struct {
 	clientsCount atomic.Uint64
+	// set once the server stops accepting handshakes, it is never reset, see Shutdown
+	shuttingDown atomic.Bool
 
 	events.EventEmitter
 
 	// Prototype interface, used to implement interface method rewriting
 	_proto_ BaseServer
 
-	clients     *_types.Map[string, Socket]
-	middlewares []Middleware
-	opts        config.ServerOptionsInterface
+	clients *_types.Map[string, Socket]
+	// the closed sessions retained for the connection state recovery
+	disconnected *_types.Map[string, *disconnectedSocket]
+	middlewares  []Middleware
+	opts         config.ServerOptionsInterface
+	metrics      *types.Metrics
 }
 
 func MakeBaseServer() BaseServer {
 	baseServer := &baseServer{
 		EventEmitter: events.New(),
 
-		clients: &_types.Map[string, Socket]{},
+		clients:      &_types.Map[string, Socket]{},
+		disconnected: &_types.Map[string, *disconnectedSocket]{},
 	}
 
+	baseServer.metrics = types.NewMetrics(baseServer.ClientsCount)
+
 	baseServer.Prototype(baseServer)
 
 	return baseServer
@@ -85,6 +114,10 @@ func (bs *baseServer) ClientsCount() uint64 {
 	return bs.clientsCount.Load()
 }
 
+func (bs *baseServer) Metrics() *types.Metrics {
+	return bs.metrics
+}
+
 func (bs *baseServer) Middlewares() []Middleware {
 	return bs.middlewares
 }
@@ -114,6 +147,17 @@ func (bs *baseServer) Construct(opt any) {
 		if cors := bs.opts.Cors(); cors != nil {
 			bs.Use(types.MiddlewareWrapper(cors))
 		}
+
+		if initialPacket := bs.opts.InitialPacket(); initialPacket != nil && bs.opts.InitialPacketFunc() == nil {
+			// the reader is buffered, so that every client gets the whole packet
+			data, binary, err := readData(initialPacket)
+			if err != nil {
+				server_log.Debug("error while reading the initial packet: %s", err.Error())
+			}
+			bs.opts.SetInitialPacketFunc(func(*types.HttpContext) (io.Reader, error) {
+				return dataReader(data, binary), nil
+			})
+		}
 	}
 
 	bs._proto_.Init()
@@ -148,56 +192,95 @@ func (bs *baseServer) Upgrades(transport string) *_types.Set[string] {
 	if !bs.opts.AllowUpgrades() {
 		return _types.NewSet[string]()
 	}
-	return transports.Transports()[transport].UpgradesTo
+	if factory, ok := transports.Lookup(transport); ok {
+		return factory.UpgradesTo
+	}
+	return _types.NewSet[string]()
 }
 
 // Verifies a request.
+//
+// Deprecated: use VerifyRequest, which returns a *HandshakeError.
 func (bs *baseServer) Verify(ctx *types.HttpContext, upgrade bool) (int, map[string]any) {
+	if err := bs._proto_.VerifyRequest(ctx, upgrade); err != nil {
+		herr := asHandshakeError(err)
+		return herr.Code, herr.Context()
+	}
+	return OK_REQUEST, nil
+}
+
+// Verifies a request, returns a *HandshakeError if it is rejected.
+func (bs *baseServer) VerifyRequest(ctx *types.HttpContext, upgrade bool) error {
 	// transport check
-	transport := ctx.Query().Peek("transport")
-	if !bs.opts.Transports().Has(transport) {
+	transport := strings.Clone(ctx.Query().Peek("transport"))
+	// the transports established through their own session, e.g. webtransport, are not served over HTTP
+	factory, ok := transports.Lookup(transport)
+	if !ok || !bs.opts.Transports().Has(transport) || factory.HandlesSessions {
 		server_log.Debug(`unknown transport "%s"`, transport)
-		return UNKNOWN_TRANSPORT, map[string]any{"transport": transport}
+		return &HandshakeError{Code: UNKNOWN_TRANSPORT, Transport: transport}
 	}
 
 	// 'Origin' header check
 	if origin := ctx.Headers().Peek("Origin"); utils.CheckInvalidHeaderChar(origin) {
+		origin = strings.Clone(origin)
 		ctx.Headers().Remove("Origin")
 		server_log.Debug("origin header invalid")
-		return BAD_REQUEST, map[string]any{"name": "INVALID_ORIGIN", "origin": origin}
+		return &HandshakeError{Code: BAD_REQUEST, Name: "INVALID_ORIGIN", Origin: origin}
+	}
+
+	if err := verifyOrigin(bs.opts, ctx); err != nil {
+		return err
 	}
 
 	// sid check
-	sid := ctx.Query().Peek("sid")
+	sid := strings.Clone(ctx.Query().Peek("sid"))
 	if len(sid) > 0 {
+		// the open sessions keep being served while they drain, but do not upgrade anymore
+		if upgrade && bs.shuttingDown.Load() {
+			server_log.Debug("server shutting down, rejecting upgrade")
+			return &HandshakeError{Code: SERVICE_UNAVAILABLE, Sid: sid}
+		}
 		scoket, ok := bs.clients.Load(sid)
 		if !ok {
 			server_log.Debug(`unknown sid "%s"`, sid)
-			return UNKNOWN_SID, map[string]any{"sid": sid}
+			return &HandshakeError{Code: UNKNOWN_SID, Sid: sid}
 		}
 		if previousTransport := scoket.(Socket).Transport().Name(); !upgrade && previousTransport != transport {
 			server_log.Debug("bad request: unexpected transport without upgrade")
-			return BAD_REQUEST, map[string]any{"name": "TRANSPORT_MISMATCH", "transport": transport, "previousTransport": previousTransport}
+			return &HandshakeError{Code: BAD_REQUEST, Name: "TRANSPORT_MISMATCH", Transport: transport, PreviousTransport: previousTransport}
 		}
 	} else {
 		// handshake is GET only
 		if method := ctx.Method(); fasthttp.MethodGet != method {
-			return BAD_HANDSHAKE_METHOD, map[string]any{"method": method}
+			return &HandshakeError{Code: BAD_HANDSHAKE_METHOD, Method: strings.Clone(method)}
 		}
 
-		if transport == "websocket" && !upgrade {
+		if factory.HandlesUpgrades && !upgrade {
 			server_log.Debug("invalid transport upgrade")
-			return BAD_REQUEST, map[string]any{"name": "TRANSPORT_HANDSHAKE_ERROR"}
+			return &HandshakeError{Code: BAD_REQUEST, Name: "TRANSPORT_HANDSHAKE_ERROR"}
 		}
 
 		if allowRequest := bs.opts.AllowRequest(); allowRequest != nil {
 			if err := allowRequest(ctx); err != nil {
-				return FORBIDDEN, map[string]any{"message": err.Error()}
+				return &HandshakeError{Code: FORBIDDEN, Message: err.Error(), Err: err}
 			}
 		}
 	}
 
-	return OK_REQUEST, nil
+	return nil
+}
+
+// Checks the "Origin" header of a request against the AllowedOrigins option.
+func verifyOrigin(opts config.ServerOptionsInterface, ctx *types.HttpContext) *HandshakeError {
+	allowedOrigins := opts.AllowedOrigins()
+	if allowedOrigins == nil {
+		return nil
+	}
+	if origin := ctx.Headers().Peek("Origin"); origin != "" && !types.IsOriginAllowed(origin, allowedOrigins, ctx) {
+		server_log.Debug(`origin "%s" not allowed`, origin)
+		return &HandshakeError{Code: FORBIDDEN, Name: "ORIGIN_NOT_ALLOWED", Origin: strings.Clone(origin)}
+	}
+	return nil
 }
 
 // Adds a new middleware.
@@ -241,6 +324,11 @@ func (bs *baseServer) Close() BaseServer {
 		client.Close(true)
 		return true
 	})
+	bs.disconnected.Range(func(id string, disconnected *disconnectedSocket) bool {
+		utils.ClearTimeout(disconnected.timer)
+		bs.disconnected.Delete(id)
+		return true
+	})
 
 	bs._proto_.Cleanup()
 
@@ -250,14 +338,207 @@ func (bs *baseServer) Close() BaseServer {
 func (bs *baseServer) Cleanup() {
 }
 
+// Gracefully closes all clients.
+//
+// The server stops accepting handshakes, then each client flushes its buffered packets and closes its
+// transport, which sends a close packet. The clients which are still open once the context is done are
+// closed right away. Returns the number of clients closed that way, with the error of the context if any.
+//
+// The handshakes stay rejected afterwards, the server being shut down for good: it cannot be reused, a new one is to
+// be created instead.
+func (bs *baseServer) Shutdown(ctx context.Context) (int, error) {
+	server_log.Debug("shutting down")
+	bs.shuttingDown.Store(true)
+
+	var wg sync.WaitGroup
+	bs.clients.Range(func(_ string, client Socket) bool {
+		wg.Add(1)
+		var once sync.Once
+		done := func(...any) { once.Do(wg.Done) }
+		client.Once("close", done)
+		if "closed" == client.ReadyState() {
+			done()
+		}
+		client.Close(false)
+		return true
+	})
+
+	drained := make(chan _types.Void)
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	forced := 0
+	bs.clients.Range(func(id string, client Socket) bool {
+		server_log.Debug(`forcing the close of client "%s"`, id)
+		client.Transport().Discard()
+		client.OnClose("forced close")
+		forced++
+		return true
+	})
+	bs.disconnected.Range(func(id string, disconnected *disconnectedSocket) bool {
+		utils.ClearTimeout(disconnected.timer)
+		bs.disconnected.Delete(id)
+		return true
+	})
+
+	bs._proto_.Cleanup()
+
+	return forced, err
+}
+
+// Sends a message packet to all the open clients.
+// Returns the clients to which the packet could not be sent, with the reason.
+func (bs *baseServer) Broadcast(data io.Reader, options *packet.Options) map[string]error {
+	return bs.BroadcastExcept(data, options)
+}
+
+// Sends a message packet to all the open clients but the given ones. The data is read once, and encoded once per
+// protocol revision and binary support, the websocket clients sharing the same prepared frames.
+//
+// The packet is dropped for the clients whose write buffer is full, whatever its policy, the WriteBufferBlock one
+// included, so that a slow client never holds up the others.
+// Returns the clients to which the packet could not be sent, with the reason.
+func (bs *baseServer) BroadcastExcept(data io.Reader, options *packet.Options, except ...string) map[string]error {
+	failures := map[string]error{}
+
+	buf, binary, err := readData(data)
+	if err != nil {
+		server_log.Debug("error while reading the broadcast data: %s", err.Error())
+		bs.clients.Range(func(id string, _ Socket) bool {
+			failures[id] = err
+			return true
+		})
+		return failures
+	}
+
+	compress := options == nil || options.Compress
+	excluded := _types.NewSet(except...)
+
+	type frameKey struct {
+		protocol       int
+		supportsBinary bool
+	}
+	frames := map[frameKey]p_types.BufferInterface{}
+	frame := func(key frameKey) p_types.BufferInterface {
+		if f, ok := frames[key]; ok {
+			return f
+		}
+		p := parser.Parserv4()
+		if key.protocol == 3 {
+			p = parser.Parserv3()
+		}
+		var f p_types.BufferInterface
+		if encoded, err := p.EncodePacket(&packet.Packet{Type: packet.MESSAGE, Data: dataReader(buf, binary)}, key.supportsBinary); err != nil {
+			server_log.Debug("error while encoding the broadcast packet: %s", err.Error())
+		} else if prepared, err := transports.NewPreparedFrame(encoded); err != nil {
+			server_log.Debug("error while preparing the broadcast frame: %s", err.Error())
+		} else {
+			f = prepared
+		}
+		frames[key] = f
+		return f
+	}
+
+	bs.clients.Range(func(id string, client Socket) bool {
+		if excluded.Has(id) {
+			return true
+		}
+		s, ok := client.(*socket)
+		if !ok {
+			client.Send(dataReader(buf, binary), options, nil)
+			return true
+		}
+		opts := &packet.Options{Compress: compress}
+		if transport := s.Transport(); transport != nil {
+			// a nil frame lets the transport encode the packet
+			if f := frame(frameKey{s.Protocol(), transport.SupportsBinary()}); f != nil {
+				opts.WsPreEncodedFrame = f
+			}
+		}
+		// a broadcast does not wait for the clients whose write buffer is full
+		if err := s.queuePacket(packet.MESSAGE, dataReader(buf, binary), opts, nil, false); err != nil {
+			failures[id] = err
+		}
+		return true
+	})
+
+	return failures
+}
+
 // generate a socket id.
 // Overwrite this method to generate your custom socket id
 func (bs *baseServer) GenerateId(*types.HttpContext) (string, error) {
 	return utils.Base64Id().GenerateId()
 }
 
+// Emits a "connection_error" event, records it to the metrics and logs it.
+func emitConnectionError(server BaseServer, ctx *types.HttpContext, err *HandshakeError) {
+	if server.ListenerCount("connection_error") > 0 {
+		// handed over to the listeners, which may keep it
+		ctx.Retain()
+	}
+
+	server.Metrics().ConnectionError(err.Code)
+
+	errorContext := err.Context()
+
+	if logger := server.Opts().Logger(); logger != nil {
+		attrs := []slog.Attr{
+			slog.Int("code", err.Code),
+			slog.String("message", err.message()),
+			slog.String("transport", ctx.Query().Peek("transport")),
+			slog.String("remote_address", ctx.RemoteAddress()),
+		}
+		if sid := ctx.Query().Peek("sid"); sid != "" {
+			attrs = append(attrs, slog.String("sid", sid))
+		}
+		keys := make([]string, 0, len(errorContext))
+		for key := range errorContext {
+			// already part of the record
+			if key != "message" && key != "transport" && key != "sid" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			attrs = append(attrs, slog.Any(key, errorContext[key]))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelWarn, "connection error", attrs...)
+	}
+
+	server.Emit("connection_error", &types.ErrorMessage{
+		CodeMessage: &types.CodeMessage{
+			Code:    err.Code,
+			Message: errorMessages[err.Code],
+		},
+		Req:     ctx,
+		Context: errorContext,
+		Err:     err,
+	})
+}
+
 // Handshakes a new client.
+//
+// Deprecated: use HandshakeRequest, which returns a *HandshakeError.
 func (bs *baseServer) Handshake(transportName string, ctx *types.HttpContext) (int, transports.Transport) {
+	transport, err := bs._proto_.HandshakeRequest(transportName, ctx)
+	if err != nil {
+		return asHandshakeError(err).Code, nil
+	}
+	return OK_REQUEST, transport
+}
+
+// Handshakes a new client, returns a *HandshakeError if it is rejected.
+func (bs *baseServer) HandshakeRequest(transportName string, ctx *types.HttpContext) (transports.Transport, error) {
 	protocol := 3 // 3rd revision by default
 	if ctx.Query().Peek("EIO") == "4" {
 		protocol = 4
@@ -265,62 +546,127 @@ func (bs *baseServer) Handshake(transportName string, ctx *types.HttpContext) (i
 
 	if protocol == 3 && !bs.opts.AllowEIO3() {
 		server_log.Debug("unsupported protocol version")
-		bs.Emit("connection_error", &types.ErrorMessage{
-			CodeMessage: &types.CodeMessage{
-				Code:    UNSUPPORTED_PROTOCOL_VERSION,
-				Message: errorMessages[UNSUPPORTED_PROTOCOL_VERSION],
-			},
-			Req: ctx,
-			Context: map[string]any{
-				"protocol": protocol,
-			},
-		})
-		return UNSUPPORTED_PROTOCOL_VERSION, nil
+		err := &HandshakeError{Code: UNSUPPORTED_PROTOCOL_VERSION, Protocol: protocol}
+		emitConnectionError(bs._proto_, ctx, err)
+		return nil, err
+	}
+
+	if bs.shuttingDown.Load() {
+		server_log.Debug("server shutting down, rejecting handshake")
+		err := &HandshakeError{Code: SERVICE_UNAVAILABLE}
+		emitConnectionError(bs._proto_, ctx, err)
+		return nil, err
+	}
+
+	if transport, err := bs.recover(transportName, ctx, protocol); transport != nil || err != nil {
+		return transport, err
 	}
 
 	id, err := bs.GenerateId(ctx)
 	if err != nil {
 		server_log.Debug("error while generating an id")
-		bs.Emit("connection_error", &types.ErrorMessage{
-			CodeMessage: &types.CodeMessage{
-				Code:    BAD_REQUEST,
-				Message: errorMessages[BAD_REQUEST],
-			},
-			Req: ctx,
-			Context: map[string]any{
-				"name":  "ID_GENERATION_ERROR",
-				"error": err,
-			},
-		})
-		return BAD_REQUEST, nil
+		herr := &HandshakeError{Code: BAD_REQUEST, Name: "ID_GENERATION_ERROR", Err: err}
+		emitConnectionError(bs._proto_, ctx, herr)
+		return nil, herr
+	}
+
+	var initialPacket io.Reader
+	if initialPacketFunc := bs.opts.InitialPacketFunc(); initialPacketFunc != nil {
+		if initialPacket, err = initialPacketFunc(ctx); err != nil {
+			server_log.Debug("error while creating the initial packet")
+			herr := &HandshakeError{Code: BAD_REQUEST, Name: "INITIAL_PACKET_ERROR", Err: err}
+			emitConnectionError(bs._proto_, ctx, herr)
+			return nil, herr
+		}
 	}
 
 	server_log.Debug(`handshaking client "%s" (%s)`, id, transportName)
 
-	transport, err := bs._proto_.CreateTransport(transportName, ctx)
+	transport, err := bs.createTransport(transportName, ctx)
 	if err != nil {
-		server_log.Debug(`handshaking client "%s" (%s)`, id, transportName)
-		bs.Emit("connection_error", &types.ErrorMessage{
-			CodeMessage: &types.CodeMessage{
-				Code:    BAD_REQUEST,
-				Message: errorMessages[BAD_REQUEST],
-			},
-			Req: ctx,
-			Context: map[string]any{
-				"name":  "TRANSPORT_HANDSHAKE_ERROR",
-				"error": err,
-			},
-		})
-		return BAD_REQUEST, nil
+		return nil, err
+	}
+
+	socket := newSocket(id, bs, transport, ctx, protocol, initialPacket)
+
+	transport.OnRequest(ctx)
+
+	bs.register(socket)
+	bs.metrics.Handshake(transportName)
+
+	bs.Emit("connection", socket)
+
+	return transport, nil
+}
+
+// Resumes the session designated by the "recover" query parameter, if the connection state recovery allows it.
+// It returns a nil transport and a nil error when a new session has to be created instead.
+func (bs *baseServer) recover(transportName string, ctx *types.HttpContext, protocol int) (transports.Transport, error) {
+	id := ctx.Query().Peek("recover")
+	if bs.opts.ConnectionStateRecovery() == nil || id == "" {
+		return nil, nil
 	}
-	if "polling" == transportName {
-		transport.SetMaxHttpBufferSize(bs.opts.MaxHttpBufferSize())
-		transport.SetHttpCompression(bs.opts.HttpCompression())
-	} else if "websocket" == transportName {
-		transport.SetPerMessageDeflate(bs.opts.PerMessageDeflate())
+
+	offset, err := strconv.ParseUint(ctx.Query().Peek("offset"), 10, 64)
+	if err != nil {
+		server_log.Debug(`invalid recovery offset "%s"`, ctx.Query().Peek("offset"))
+		return nil, nil
 	}
 
-	socket := NewSocket(id, bs, transport, ctx, protocol)
+	disconnected, ok := bs.disconnected.Load(id)
+	if !ok || disconnected.socket.Protocol() != protocol || !disconnected.socket.Recoverable(offset) {
+		server_log.Debug(`session "%s" cannot be recovered`, id)
+		return nil, nil
+	}
+	// another request may be recovering the same session
+	if !bs.disconnected.CompareAndDelete(id, disconnected) {
+		return nil, nil
+	}
+	utils.ClearTimeout(disconnected.timer)
+
+	server_log.Debug(`recovering client "%s" (%s)`, id, transportName)
+
+	transport, err := bs.createTransport(transportName, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := disconnected.socket
+	socket.Recover(transport, ctx, offset)
+
+	transport.OnRequest(ctx)
+
+	bs.register(socket)
+
+	bs.Emit("recovered", socket)
+
+	return transport, nil
+}
+
+// Applies the server options to a transport, each transport using the ones it supports, e.g. the http compression for
+// the polling transports or the permessage-deflate extension for the websocket one.
+func configureTransport(transport transports.Transport, opts config.ServerOptionsInterface, metrics *types.Metrics) {
+	transport.SetMaxHttpBufferSize(opts.MaxHttpBufferSize())
+	transport.SetHttpCompression(opts.HttpCompression())
+	transport.SetHttpCompressionLevels(opts.HttpCompressionLevels())
+	transport.SetPerMessageDeflate(opts.PerMessageDeflate())
+	// a backstop to the heartbeat, which closes the silent sessions first
+	transport.SetReadTimeout(opts.PingInterval() + 2*opts.PingTimeout())
+	transport.SetWriteTimeout(opts.WriteTimeout())
+	transport.SetMaxStall(opts.MaxStall())
+	transport.SetMetrics(metrics)
+}
+
+// Creates and configures the transport of a new session.
+func (bs *baseServer) createTransport(transportName string, ctx *types.HttpContext) (transports.Transport, error) {
+	transport, err := bs._proto_.CreateTransport(transportName, ctx)
+	if err != nil {
+		server_log.Debug(`error while creating the "%s" transport`, transportName)
+		herr := &HandshakeError{Code: BAD_REQUEST, Name: "TRANSPORT_HANDSHAKE_ERROR", Err: err}
+		emitConnectionError(bs._proto_, ctx, herr)
+		return nil, herr
+	}
+	configureTransport(transport, bs.opts, bs.metrics)
 
 	transport.On("headers", func(args ...any) {
 		headers, req := args[0].(*utils.ParameterBag), args[1].(*types.HttpContext)
@@ -333,19 +679,39 @@ func (bs *baseServer) Handshake(transportName string, ctx *types.HttpContext) (i
 		bs.Emit("headers", headers, req)
 	})
 
-	transport.OnRequest(ctx)
+	return transport, nil
+}
+
+// Tracks an open socket, and retains it once closed if the connection state recovery is enabled.
+func (bs *baseServer) register(socket Socket) {
+	id := socket.Id()
 
 	bs.clients.Store(id, socket)
 	bs.clientsCount.Add(1)
 
-	socket.Once("close", func(...any) {
+	socket.Once("close", func(reason ...any) {
 		bs.clients.Delete(id)
 		bs.clientsCount.Add(^uint64(0))
-	})
 
-	bs.Emit("connection", socket)
+		recovery := bs.opts.ConnectionStateRecovery()
+		if recovery == nil || len(reason) == 0 {
+			return
+		}
+		if r, _ := reason[0].(string); !recoverableReasons.Has(r) {
+			return
+		}
 
-	return OK_REQUEST, transport
+		duration := recovery.MaxDisconnectionDuration
+		if duration <= 0 {
+			duration = 2 * time.Minute
+		}
+		disconnected := &disconnectedSocket{socket: socket}
+		disconnected.timer = utils.SetTimeout(func() {
+			server_log.Debug(`session "%s" can no longer be recovered`, id)
+			bs.disconnected.CompareAndDelete(id, disconnected)
+		}, duration)
+		bs.disconnected.Store(id, disconnected)
+	})
 }
 
 // abstract
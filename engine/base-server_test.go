@@ -0,0 +1,365 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/fasthttp/websocket"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/transports"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	_types "github.com/zishang520/engine.io/v2/types"
+)
+
+func TestBroadcast(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 1})
+	engine, addr := listen(t, opts)
+
+	dial := func() (*ws.Conn, Socket) {
+		t.Helper()
+
+		sockets := make(chan Socket, 1)
+		engine.Once("connection", func(args ...any) {
+			sockets <- args[0].(Socket)
+		})
+		conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		// open packet
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		return conn, <-sockets
+	}
+
+	conn1, _ := dial()
+	conn2, socket2 := dial()
+	polling, url := openPolling(t, engine, addr)
+
+	if failures := engine.Broadcast(strings.NewReader("hello"), nil); len(failures) != 0 {
+		t.Fatalf("Broadcast() = %v, want match for no failures", failures)
+	}
+	for _, conn := range []*ws.Conn{conn1, conn2} {
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "4hello" {
+			t.Fatalf(`ReadMessage() = %q, %v, want match for "4hello"`, message, err)
+		}
+	}
+
+	t.Run("binary", func(t *testing.T) {
+		failures := engine.BroadcastExcept(bytes.NewReader([]byte{1, 2, 3}), nil, socket2.Id(), polling.Id())
+		if len(failures) != 0 {
+			t.Fatalf("BroadcastExcept() = %v, want match for no failures", failures)
+		}
+		if mt, message, err := conn1.ReadMessage(); err != nil || mt != ws.BinaryMessage || !bytes.Equal(message, []byte{1, 2, 3}) {
+			t.Fatalf(`ReadMessage() = %d, %v, %v, want match for a binary message [1 2 3]`, mt, message, err)
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		// the polling client is not polling, its write buffer is full
+		failures := engine.Broadcast(strings.NewReader("again"), nil)
+		if len(failures) != 1 || failures[polling.Id()] != ErrWriteBufferFull {
+			t.Fatalf("Broadcast() = %v, want match for a failure of %q", failures, polling.Id())
+		}
+		if payload := poll(t, url); payload != "4hello" {
+			t.Fatalf(`payload = %q, want match for %q`, payload, "4hello")
+		}
+	})
+}
+
+func TestBroadcastBlock(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 1, Policy: types.WriteBufferBlock, Timeout: 2 * time.Second})
+	engine, addr := listen(t, opts)
+
+	// neither client polls, their write buffers fill up
+	polling1, _ := openPolling(t, engine, addr)
+	polling2, _ := openPolling(t, engine, addr)
+	if failures := engine.Broadcast(strings.NewReader("hello"), nil); len(failures) != 0 {
+		t.Fatalf("Broadcast() = %v, want match for no failures", failures)
+	}
+
+	start := time.Now()
+	failures := engine.Broadcast(strings.NewReader("again"), nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Broadcast() took %s, want match for no wait on the full clients", elapsed)
+	}
+	if len(failures) != 2 || failures[polling1.Id()] != ErrWriteBufferFull || failures[polling2.Id()] != ErrWriteBufferFull {
+		t.Fatalf("Broadcast() = %v, want match for a failure of both clients", failures)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	engine, addr := listen(t, nil)
+
+	draining, url := openPolling(t, engine, addr)
+	idle, _ := openPolling(t, engine, addr)
+	draining.Send(strings.NewReader("hello"), nil, nil)
+
+	type result struct {
+		forced int
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		forced, err := engine.Shutdown(ctx)
+		results <- result{forced, err}
+	}()
+
+	if payload := poll(t, url); payload != "4hello" {
+		t.Fatalf(`payload = %q, want match for %q`, payload, "4hello")
+	}
+	// a noop packet, then the close packet
+	if payload := poll(t, url); payload != "6\x1e1" {
+		t.Fatalf(`payload = %q, want match for %q`, payload, "6\x1e1")
+	}
+
+	r := <-results
+	if r.forced != 1 || r.err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %d, %v, want match for 1, %v", r.forced, r.err, context.DeadlineExceeded)
+	}
+	for _, socket := range []Socket{draining, idle} {
+		if state := socket.ReadyState(); state != "closed" {
+			t.Fatalf(`Socket.ReadyState() = %q, want match for "closed"`, state)
+		}
+	}
+	if count := engine.ClientsCount(); count != 0 {
+		t.Fatalf("ClientsCount() = %d, want match for 0", count)
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		res, err := http.Get("http://" + addr + "/engine.io/?EIO=4&transport=polling")
+		if err != nil {
+			t.Fatalf("http.Get() error = %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("StatusCode = %d, want match for %d", res.StatusCode, http.StatusServiceUnavailable)
+		}
+		if retry := res.Header.Get("Retry-After"); retry != retryAfter {
+			t.Fatalf(`Retry-After = %q, want match for %q`, retry, retryAfter)
+		}
+	})
+}
+
+func TestShutdownWebSocketStall(t *testing.T) {
+	opts := &config.ServerOptions{}
+	// the writes never time out
+	opts.SetWriteTimeout(0)
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+	transport := socket.Transport()
+	closed := make(chan struct{})
+	transport.Once("close", func(...any) {
+		close(closed)
+	})
+
+	// the peer does not read, so that the writes end up blocked
+	message := strings.Repeat("a", 256<<10)
+	for i := 0; i < 64; i++ {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	forced, err := engine.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown() took %s, want match for the context timeout", elapsed)
+	}
+	if forced != 1 || err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %d, %v, want match for 1, %v", forced, err, context.DeadlineExceeded)
+	}
+
+	// the connection is closed, its blocked write failing
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal(`transport did not emit "close" after the forced close`)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	engine, addr := listen(t, nil)
+
+	socket, url := openPolling(t, engine, addr)
+	socket.Send(strings.NewReader("hello"), nil, nil)
+	if payload := poll(t, url); payload != "4hello" {
+		t.Fatalf(`payload = %q, want match for %q`, payload, "4hello")
+	}
+	poll(t, "http://"+addr+"/engine.io/?EIO=4&transport=unknown")
+
+	metrics := engine.Metrics()
+	if count := metrics.Handshakes("polling"); count != 1 {
+		t.Fatalf(`Handshakes("polling") = %d, want match for 1`, count)
+	}
+	if count := metrics.ConnectionErrors(UNKNOWN_TRANSPORT); count != 1 {
+		t.Fatalf(`ConnectionErrors(UNKNOWN_TRANSPORT) = %d, want match for 1`, count)
+	}
+	// the open packet, then the message packet
+	if sent := metrics.SentBytes("polling"); sent <= uint64(len("4hello")) {
+		t.Fatalf(`SentBytes("polling") = %d, want match for more than %d`, sent, len("4hello"))
+	}
+
+	socket.Close(false)
+	// the close packet is sent on the next poll
+	poll(t, url)
+	if count := metrics.Disconnections("forced close"); count != 1 {
+		t.Fatalf(`Disconnections("forced close") = %d, want match for 1`, count)
+	}
+
+	exposition := string(metrics.Bytes())
+	for _, line := range []string{
+		"engineio_clients 0\n",
+		`engineio_handshakes_total{transport="polling"} 1` + "\n",
+		`engineio_connection_errors_total{code="0"} 1` + "\n",
+		`engineio_disconnections_total{reason="forced close"} 1` + "\n",
+		`engineio_flush_packets_bucket{transport="polling",le="1"} 2` + "\n",
+		`engineio_flush_packets_count{transport="polling"} 2` + "\n",
+	} {
+		if !strings.Contains(exposition, line) {
+			t.Fatalf("Bytes() = %q, want match for a line %q", exposition, line)
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetAllowedOrigins([]any{
+		"https://example.com",
+		"https://*.example.com",
+		regexp.MustCompile(`^http://localhost:\d+$`),
+		types.OriginFunc(func(origin string, _ *types.HttpContext) bool { return origin == "app://local" }),
+	})
+	engine, addr := listen(t, opts)
+
+	errs := make(chan *types.ErrorMessage, 1)
+	engine.On("connection_error", func(args ...any) {
+		errs <- args[0].(*types.ErrorMessage)
+	})
+
+	handshake := func(origin string) int {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/engine.io/?EIO=4&transport=polling", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Do() error = %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, origin := range []string{"", "https://example.com", "https://a.example.com", "http://localhost:3000", "app://local"} {
+		if status := handshake(origin); status != http.StatusOK {
+			t.Fatalf("handshake(%q) = %d, want match for %d", origin, status, http.StatusOK)
+		}
+	}
+
+	for _, origin := range []string{"https://evil.com", "https://example.com.evil.com", "https://evilexample.com", "https://a.example.com:8443", "http://localhost"} {
+		if status := handshake(origin); status != http.StatusForbidden {
+			t.Fatalf("handshake(%q) = %d, want match for %d", origin, status, http.StatusForbidden)
+		}
+		if e := <-errs; e.Code != FORBIDDEN || e.Context["name"] != "ORIGIN_NOT_ALLOWED" {
+			t.Fatalf("connection_error = %v %v, want match for FORBIDDEN ORIGIN_NOT_ALLOWED", e.Code, e.Context)
+		}
+	}
+
+	t.Run("upgrade", func(t *testing.T) {
+		_, res, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", http.Header{"Origin": {"https://evil.com"}})
+		if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+			t.Fatalf("Dial() = %v, %v, want match for a %d response", res, err, http.StatusForbidden)
+		}
+		<-errs
+	})
+}
+
+// A polling transport registered under another name.
+type customTransport struct {
+	transports.Polling
+}
+
+func (c *customTransport) Name() string {
+	return "custom"
+}
+
+func TestRegisteredTransport(t *testing.T) {
+	transports.Register("custom", &transports.TransportFactory{
+		New: func(ctx *types.HttpContext) transports.Transport {
+			return &customTransport{Polling: transports.NewPolling(ctx)}
+		},
+	})
+	defer transports.Unregister("custom")
+
+	opts := &config.ServerOptions{}
+	opts.SetTransports(_types.NewSet("custom", "webtransport"))
+	engine, addr := listen(t, opts)
+
+	messages := make(chan string, 1)
+	engine.On("connection", func(args ...any) {
+		args[0].(Socket).On("message", func(args ...any) {
+			messages <- args[0].(interface{ String() string }).String()
+		})
+	})
+
+	open := poll(t, "http://"+addr+"/engine.io/?EIO=4&transport=custom")
+	var handshake struct {
+		Sid string `json:"sid"`
+	}
+	if err := json.Unmarshal([]byte(open[1:]), &handshake); err != nil {
+		t.Fatalf("json.Unmarshal(%q) error = %v", open, err)
+	}
+
+	// the server options apply to the registered transports too
+	res, err := http.Post("http://"+addr+"/engine.io/?EIO=4&transport=custom&sid="+handshake.Sid, "text/plain;charset=UTF-8", strings.NewReader("4hello"))
+	if err != nil {
+		t.Fatalf("http.Post() error = %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("StatusCode = %d, want match for %d", res.StatusCode, http.StatusOK)
+	}
+	select {
+	case message := <-messages:
+		if message != "hello" {
+			t.Fatalf(`message = %q, want match for %q`, message, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the message")
+	}
+
+	// established through its own session only
+	res, err = http.Get("http://" + addr + "/engine.io/?EIO=4&transport=webtransport")
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("StatusCode = %d, want match for %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
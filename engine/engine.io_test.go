@@ -0,0 +1,334 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/fasthttp/websocket"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	"github.com/zishang520/engine.io/v2/utils"
+)
+
+// Starts an engine attached to a HTTP server listening on a loopback port, and returns its address.
+func listen(t *testing.T, opts any, options ...types.ListenOption) (Server, string) {
+	t.Helper()
+
+	var addr string
+	httpServer := types.NewWebServer(nil)
+	httpServer.Once("listening", func(args ...any) {
+		addr = args[0].(net.Addr).String()
+	})
+	httpServer.Listen("127.0.0.1:0", nil, options...)
+	t.Cleanup(func() {
+		// fasthttp does not close the connections that are yet to send their first request, e.g. the ones
+		// dialed ahead by the client, so that the shutdown would wait for the client to close them.
+		http.DefaultClient.CloseIdleConnections()
+		httpServer.Close(nil)
+	})
+
+	if addr == "" {
+		t.Fatal(`httpServer.Listen() did not emit "listening"`)
+	}
+
+	return Attach(httpServer, opts), addr
+}
+
+// Performs a polling request and returns the response body.
+func poll(t *testing.T, url string) string {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	defer res.Body.Close()
+
+	body := new(strings.Builder)
+	if _, err := io.Copy(body, res.Body); err != nil {
+		t.Fatal(err)
+	}
+	return body.String()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	engine, addr := listen(t, nil, types.WithProxyProtocol(&types.ProxyProtocol{
+		Upstreams: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		Timeout:   time.Second,
+	}))
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("net.Dial() error = %v", err)
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 5555 80\r\nGET /engine.io/?EIO=4&transport=polling HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("http.ReadResponse() error = %v", err)
+		}
+		res.Body.Close()
+
+		if socket := <-sockets; socket.PeerAddress() != "203.0.113.7:5555" {
+			t.Fatalf("PeerAddress() = %q, want match for %q", socket.PeerAddress(), "203.0.113.7:5555")
+		}
+	})
+
+	t.Run("v2 websocket", func(t *testing.T) {
+		dialer := &ws.Dialer{NetDial: func(network, address string) (net.Conn, error) {
+			conn, err := net.Dial(network, address)
+			if err != nil {
+				return nil, err
+			}
+			header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24")
+			header = append(header, netip.MustParseAddr("2001:db8::1").AsSlice()...)
+			header = append(header, netip.IPv6Loopback().AsSlice()...)
+			header = binary.BigEndian.AppendUint16(header, 4711)
+			header = binary.BigEndian.AppendUint16(header, 443)
+			if _, err := conn.Write(header); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}}
+		conn, _, err := dialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+
+		if socket := <-sockets; socket.PeerAddress() != "[2001:db8::1]:4711" {
+			t.Fatalf("PeerAddress() = %q, want match for %q", socket.PeerAddress(), "[2001:db8::1]:4711")
+		}
+	})
+
+	t.Run("addresses before the header", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() error = %v", err)
+		}
+		ln = types.NewProxyProtocolListener(ln, &types.ProxyProtocol{Timeout: time.Minute})
+		defer ln.Close()
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial() error = %v", err)
+		}
+		defer client.Close()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept() error = %v", err)
+		}
+		defer conn.Close()
+
+		// the header is yet to be sent, the addresses are the ones of the connection
+		start := time.Now()
+		if addr := conn.RemoteAddr().String(); addr != client.LocalAddr().String() {
+			t.Fatalf("RemoteAddr() = %q, want match for %q", addr, client.LocalAddr().String())
+		}
+		if addr := conn.LocalAddr().String(); addr != ln.Addr().String() {
+			t.Fatalf("LocalAddr() = %q, want match for %q", addr, ln.Addr().String())
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("the addresses took %s, want them without waiting for the header", elapsed)
+		}
+
+		io.WriteString(client, "PROXY TCP4 203.0.113.7 198.51.100.1 5555 80\r\nx")
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if addr := conn.RemoteAddr().String(); addr != "203.0.113.7:5555" {
+			t.Fatalf("RemoteAddr() = %q, want match for %q", addr, "203.0.113.7:5555")
+		}
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		if _, err := http.Get("http://" + addr + "/engine.io/?EIO=4&transport=polling"); err == nil {
+			t.Fatal("http.Get() error = nil, want an error")
+		}
+	})
+}
+
+func TestHttpServerListen(t *testing.T) {
+	t.Run("address in use", func(t *testing.T) {
+		_, addr := listen(t, nil)
+
+		httpServer := types.NewWebServer(nil)
+		if err := httpServer.ListenAndServe(addr); err == nil {
+			t.Fatal("ListenAndServe() error = nil, want an error")
+		}
+
+		errs := make(chan error, 1)
+		httpServer.On("error", func(args ...any) {
+			errs <- args[0].(error)
+		})
+		httpServer.On("listening", func(...any) {
+			t.Error(`Listen() emitted "listening"`)
+		})
+		httpServer.Listen(addr, func() {
+			t.Error("Listen() called fn")
+		})
+		if err := <-errs; err == nil {
+			t.Fatal(`"error" = nil, want an error`)
+		}
+	})
+
+	t.Run("address in use without an error listener", func(t *testing.T) {
+		_, addr := listen(t, nil)
+
+		var buf bytes.Buffer
+		logger := utils.Log()
+		output := logger.Writer()
+		logger.SetOutput(&buf)
+		defer logger.SetOutput(output)
+
+		types.NewWebServer(nil).Listen(addr, nil)
+		if !strings.Contains(buf.String(), "http server error") {
+			t.Fatalf("log = %q, want match for the error of the listener", buf.String())
+		}
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		addr := filepath.Join(t.TempDir(), "engine.io.sock")
+
+		httpServer := types.NewWebServer(nil)
+		Attach(httpServer, nil)
+		listening := make(chan net.Addr, 1)
+		httpServer.On("listening", func(args ...any) {
+			listening <- args[0].(net.Addr)
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- httpServer.ListenAndServeUnix(addr, 0o600)
+		}()
+
+		if bound := <-listening; bound.Network() != "unix" || bound.String() != addr {
+			t.Fatalf(`"listening" = %v, want match for %s`, bound, addr)
+		}
+
+		client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}}}
+		res, err := client.Get("http://localhost/engine.io/?EIO=4&transport=polling")
+		if err != nil {
+			t.Fatalf("client.Get() error = %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("StatusCode = %d, want match for %d", res.StatusCode, http.StatusOK)
+		}
+
+		httpServer.Close(nil)
+		if err := <-done; err != nil {
+			t.Fatalf("ListenAndServeUnix() error = %v", err)
+		}
+	})
+}
+
+func TestHttpServerTLSConfig(t *testing.T) {
+	certFile, keyFile := selfSignedCert(t, "a.example.com")
+	otherCertFile, otherKeyFile := selfSignedCert(t, "b.example.com")
+	reloader, err := types.NewCertificateReloader(
+		types.CertificateFile{CertFile: certFile, KeyFile: keyFile},
+		types.CertificateFile{CertFile: otherCertFile, KeyFile: otherKeyFile},
+	)
+	if err != nil {
+		t.Fatalf("NewCertificateReloader() error = %v", err)
+	}
+	reloads := make(chan struct{}, 1)
+	reloader.On("reload", func(...any) {
+		reloads <- struct{}{}
+	})
+	reloader.Watch(10 * time.Millisecond)
+	defer reloader.Close()
+
+	var addr string
+	httpServer := types.NewWebServer(nil)
+	httpServer.Once("listening", func(args ...any) {
+		addr = args[0].(net.Addr).String()
+	})
+	httpServer.ListenTLSConfig("127.0.0.1:0", reloader.TLSConfig(), nil)
+	defer httpServer.Close(nil)
+	engine := Attach(httpServer, nil)
+
+	// Returns the certificate served for the server name.
+	certificate := func(serverName string) *x509.Certificate {
+		t.Helper()
+
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("tls.Dial() error = %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	for serverName, want := range map[string]string{"a.example.com": "a.example.com", "b.example.com": "b.example.com", "": "a.example.com"} {
+		if names := certificate(serverName).DNSNames; len(names) != 1 || names[0] != want {
+			t.Fatalf("certificate(%q) = %v, want match for %s", serverName, names, want)
+		}
+	}
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	dialer := &ws.Dialer{TLSClientConfig: &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial("wss://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+
+	serial := certificate("a.example.com").SerialNumber
+	rotatedCertFile, rotatedKeyFile := selfSignedCert(t, "a.example.com")
+	for src, dst := range map[string]string{rotatedCertFile: certFile, rotatedKeyFile: keyFile} {
+		if err := os.Rename(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`reloader did not emit "reload"`)
+	}
+
+	if rotated := certificate("a.example.com").SerialNumber; rotated.Cmp(serial) == 0 {
+		t.Fatalf("certificate() serial = %v, want a rotated certificate", rotated)
+	}
+
+	// the established session is left untouched
+	messages := make(chan any, 1)
+	socket.On("message", func(args ...any) {
+		messages <- args[0]
+	})
+	if err := conn.WriteMessage(ws.TextMessage, []byte("4hello")); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	select {
+	case <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket did not receive the message")
+	}
+}
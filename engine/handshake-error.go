@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+)
+
+// HandshakeError is the reason why a request is rejected, it is returned by VerifyRequest and HandshakeRequest, and
+// carried by the "connection_error" events.
+//
+//	if errors.Is(err, engine.ErrBadRequest) {
+//		var herr *engine.HandshakeError
+//		errors.As(err, &herr)
+//		log.Println(herr.Name, herr.Transport)
+//	}
+type HandshakeError struct {
+	// one of the protocol error codes, e.g. BAD_REQUEST.
+	Code int
+	// the precise reason, e.g. "TRANSPORT_MISMATCH", empty if the code is precise enough.
+	Name string
+	// overrides the message of the code sent to the client, e.g. the error returned by AllowRequest.
+	Message string
+
+	Transport         string
+	PreviousTransport string
+	Sid               string
+	Method            string
+	Origin            string
+	Protocol          int
+
+	// the underlying error, if any.
+	Err error
+}
+
+// The errors matching any HandshakeError of the same code with errors.Is.
+var (
+	ErrUnknownTransport           = &HandshakeError{Code: UNKNOWN_TRANSPORT}
+	ErrUnknownSid                 = &HandshakeError{Code: UNKNOWN_SID}
+	ErrBadHandshakeMethod         = &HandshakeError{Code: BAD_HANDSHAKE_METHOD}
+	ErrBadRequest                 = &HandshakeError{Code: BAD_REQUEST}
+	ErrForbidden                  = &HandshakeError{Code: FORBIDDEN}
+	ErrUnsupportedProtocolVersion = &HandshakeError{Code: UNSUPPORTED_PROTOCOL_VERSION}
+	ErrServiceUnavailable         = &HandshakeError{Code: SERVICE_UNAVAILABLE}
+)
+
+// Returns the message sent to the client.
+func (e *HandshakeError) message() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return errorMessages[e.Code]
+}
+
+func (e *HandshakeError) Error() string {
+	msg := e.message()
+	if e.Name != "" {
+		msg += " (" + e.Name + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Reports whether the target is a *HandshakeError with the same code, and the same name if it has one.
+func (e *HandshakeError) Is(target error) bool {
+	t, ok := target.(*HandshakeError)
+	return ok && t.Code == e.Code && (t.Name == "" || t.Name == e.Name)
+}
+
+// Returns the fields which are set, as carried by the Context of the types.ErrorMessage.
+func (e *HandshakeError) Context() map[string]any {
+	context := map[string]any{}
+	for key, value := range map[string]string{
+		"name":              e.Name,
+		"message":           e.Message,
+		"transport":         e.Transport,
+		"previousTransport": e.PreviousTransport,
+		"sid":               e.Sid,
+		"method":            e.Method,
+		"origin":            e.Origin,
+	} {
+		if value != "" {
+			context[key] = value
+		}
+	}
+	if e.Protocol != 0 {
+		context["protocol"] = e.Protocol
+	}
+	if e.Err != nil {
+		context["error"] = e.Err
+	}
+	return context
+}
+
+// Returns the body of the response to the rejected request.
+func (e *HandshakeError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(types.CodeMessage{Code: e.Code, Message: e.message()})
+}
+
+// Returns the error as a *HandshakeError, an error of another type being a bad request.
+func asHandshakeError(err error) *HandshakeError {
+	var herr *HandshakeError
+	if errors.As(err, &herr) {
+		return herr
+	}
+	return &HandshakeError{Code: BAD_REQUEST, Err: err}
+}
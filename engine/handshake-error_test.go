@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+)
+
+func TestHandshakeError(t *testing.T) {
+	cause := errors.New("rejected")
+	err := error(&HandshakeError{Code: BAD_REQUEST, Name: "TRANSPORT_MISMATCH", Transport: "polling", PreviousTransport: "websocket", Err: cause})
+
+	if !errors.Is(err, ErrBadRequest) || !errors.Is(err, &HandshakeError{Code: BAD_REQUEST, Name: "TRANSPORT_MISMATCH"}) {
+		t.Fatalf("errors.Is(%v, ErrBadRequest) = false, want match for true", err)
+	}
+	if errors.Is(err, ErrForbidden) || errors.Is(err, &HandshakeError{Code: BAD_REQUEST, Name: "INVALID_ORIGIN"}) {
+		t.Fatalf("errors.Is(%v, ...) = true, want match for false", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Fatalf("errors.Is(%v, cause) = false, want match for true", err)
+	}
+
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.PreviousTransport != "websocket" {
+		t.Fatalf("errors.As(%v) = %v, want match for the *HandshakeError", err, herr)
+	}
+	if context := herr.Context(); len(context) != 4 || context["name"] != "TRANSPORT_MISMATCH" || context["previousTransport"] != "websocket" {
+		t.Fatalf("Context() = %v, want match for the name, transports and error", context)
+	}
+	if b, _ := json.Marshal(err); string(b) != `{"code":3,"message":"Bad request"}` {
+		t.Fatalf(`json.Marshal() = %s, want match for {"code":3,"message":"Bad request"}`, b)
+	}
+
+	t.Run("connection_error", func(t *testing.T) {
+		engine, addr := listen(t, nil)
+
+		errs := make(chan error, 1)
+		engine.On("connection_error", func(args ...any) {
+			errs <- args[0].(*types.ErrorMessage).Err
+		})
+		poll(t, "http://"+addr+"/engine.io/?EIO=4&transport=websocket")
+
+		var herr *HandshakeError
+		if err := <-errs; !errors.As(err, &herr) || herr.Name != "TRANSPORT_HANDSHAKE_ERROR" {
+			t.Fatalf(`ErrorMessage.Err = %v, want match for a "TRANSPORT_HANDSHAKE_ERROR" *HandshakeError`, err)
+		}
+	})
+}
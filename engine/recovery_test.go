@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/fasthttp/websocket"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+)
+
+func TestConnectionStateRecovery(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetConnectionStateRecovery(&types.ConnectionStateRecovery{MaxDisconnectionDuration: 5 * time.Second})
+
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	recovered := make(chan Socket, 1)
+	engine.On("recovered", func(args ...any) {
+		recovered <- args[0].(Socket)
+	})
+
+	dial := func(query string) (*ws.Conn, string) {
+		t.Helper()
+
+		conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket"+query, nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		_, open, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		var handshake struct {
+			Sid string `json:"sid"`
+		}
+		if err := json.Unmarshal(open[1:], &handshake); err != nil {
+			t.Fatalf("json.Unmarshal(%q) error = %v", open, err)
+		}
+		return conn, handshake.Sid
+	}
+
+	conn, sid := dial("")
+	socket := <-sockets
+
+	closed := make(chan string, 1)
+	socket.Once("close", func(args ...any) {
+		closed <- args[0].(string)
+	})
+
+	socket.Send(strings.NewReader("a"), nil, nil)
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "4a" {
+		t.Fatalf(`ReadMessage() = %q, %v, want match for "4a"`, message, err)
+	}
+	// never read by the client
+	socket.Send(strings.NewReader("b"), nil, nil)
+	conn.Close()
+
+	select {
+	case reason := <-closed:
+		if reason != "transport close" && reason != "transport error" {
+			t.Fatalf(`close reason = %q, want match for "transport close"`, reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the close event")
+	}
+
+	var recoveredConn *ws.Conn
+	defer func() {
+		if recoveredConn != nil {
+			recoveredConn.Close()
+		}
+	}()
+
+	t.Run("invalid offset", func(t *testing.T) {
+		conn, newSid := dial("&recover=" + sid + "&offset=5")
+		defer conn.Close()
+
+		if newSid == sid {
+			t.Fatalf(`sid = %q, want a new session`, newSid)
+		}
+		<-sockets
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		onRecovered := make(chan struct{}, 1)
+		socket.Once("recovered", func(...any) {
+			onRecovered <- struct{}{}
+		})
+
+		conn, recoveredSid := dial("&recover=" + sid + "&offset=1")
+		// kept open, the session must not be recovered twice
+		recoveredConn = conn
+
+		if recoveredSid != sid {
+			t.Fatalf(`sid = %q, want match for %q`, recoveredSid, sid)
+		}
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "4b" {
+			t.Fatalf(`ReadMessage() = %q, %v, want match for "4b"`, message, err)
+		}
+
+		select {
+		case s := <-recovered:
+			if s != socket {
+				t.Fatal("the recovered socket is not the closed one")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the recovered event")
+		}
+		<-onRecovered
+
+		if readyState := socket.ReadyState(); readyState != "open" {
+			t.Fatalf(`Socket.ReadyState() = %q, want match for "open"`, readyState)
+		}
+		if _, ok := engine.Clients().Load(sid); !ok {
+			t.Fatalf(`Clients().Load(%q) = false, want match for true`, sid)
+		}
+
+		socket.Send(strings.NewReader("c"), nil, nil)
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "4c" {
+			t.Fatalf(`ReadMessage() = %q, %v, want match for "4c"`, message, err)
+		}
+	})
+
+	t.Run("open session", func(t *testing.T) {
+		conn, newSid := dial("&recover=" + sid + "&offset=1")
+		defer conn.Close()
+
+		if newSid == sid {
+			t.Fatalf(`sid = %q, want a new session`, newSid)
+		}
+		<-sockets
+	})
+}
+
+func TestConnectionStateRecoveryWriteBuffer(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetConnectionStateRecovery(&types.ConnectionStateRecovery{MaxDisconnectionDuration: 5 * time.Second})
+	opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 2, Policy: types.WriteBufferDropOldest})
+	engine, addr := listen(t, opts)
+
+	socket, url := openPolling(t, engine, addr)
+	sid := socket.Id()
+
+	// "a" is dropped, the client receives "b" and "c"
+	for _, message := range []string{"a", "b", "c"} {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+	if payload := poll(t, url); payload != "4b\x1e4c" {
+		t.Fatalf(`payload = %q, want match for %q`, payload, "4b\x1e4c")
+	}
+
+	// "d" is dropped, the session is closed before "e" and "f" are received
+	for _, message := range []string{"d", "e", "f"} {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+	socket.OnClose("transport close")
+
+	payload := poll(t, "http://"+addr+"/engine.io/?EIO=4&transport=polling&recover="+sid+"&offset=2")
+	if !strings.Contains(payload, `"sid":"`+sid+`"`) {
+		t.Fatalf(`payload = %q, want the session %q to be recovered`, payload, sid)
+	}
+	if _, replay, _ := strings.Cut(payload, "\x1e"); replay != "4e\x1e4f" {
+		t.Fatalf(`replayed packets = %q, want match for %q`, replay, "4e\x1e4f")
+	}
+}
@@ -1,28 +1,41 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/fasthttp/websocket"
 	"github.com/savsgio/gotils/strconv"
 	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io-go-parser/packet"
+	"github.com/zishang520/engine.io-go-parser/parser"
+	_types "github.com/zishang520/engine.io-go-parser/types"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/transports"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
 	"github.com/zishang520/engine.io/v2/errors"
 	"github.com/zishang520/engine.io/v2/utils"
+	webtrans "github.com/zishang520/engine.io/v2/webtransport"
 )
 
+// The delay in seconds after which the clients are told to retry while the server is shutting down.
+const retryAfter = "5"
+
 type server struct {
 	BaseServer
 
-	httpServer *types.HttpServer
+	httpServer  *types.HttpServer
+	httpHandler http.Handler
 }
 
 // new server.
 func MakeServer() Server {
 	s := &server{BaseServer: MakeBaseServer()}
+	s.httpHandler = types.NewHttpHandler(s)
 
 	s.Prototype(s)
 
@@ -53,8 +66,8 @@ func (s *server) Cleanup() {
 }
 
 func (s *server) CreateTransport(transportName string, ctx *types.HttpContext) (transports.Transport, error) {
-	if transport, ok := transports.Transports()[transportName]; ok {
-		return transport.New(ctx), nil
+	if factory, ok := transports.Lookup(transportName); ok {
+		return factory.New(ctx), nil
 	}
 	return nil, errors.New("unsupported transportName").Err()
 }
@@ -63,9 +76,9 @@ func (s *server) CreateTransport(transportName string, ctx *types.HttpContext) (
 func (s *server) HandleRequest(ctx *types.HttpContext) {
 	server_log.Debug(`handling "%s" http request "%s"`, ctx.Method(), strconv.B2S(ctx.RequestCtx().RequestURI()))
 
-	callback := func(errorCode int, errorContext map[string]any) {
-		if errorContext != nil {
-			s.emitAbortRequest(ctx, errorCode, errorContext)
+	callback := func(err error) {
+		if err != nil {
+			s.emitAbortRequest(ctx, asHandshakeError(err))
 			return
 		}
 
@@ -74,20 +87,20 @@ func (s *server) HandleRequest(ctx *types.HttpContext) {
 			if socket, ok := s.Clients().Load(sid); ok {
 				socket.Transport().OnRequest(ctx)
 			} else {
-				abortRequest(ctx, UNKNOWN_SID, map[string]any{"sid": sid})
+				abortRequest(ctx, &HandshakeError{Code: UNKNOWN_SID, Sid: strings.Clone(sid)})
 			}
 		} else {
-			if errorCode, t := s.Handshake(ctx.Query().Peek("transport"), ctx); t == nil {
-				abortRequest(ctx, errorCode, nil)
+			if _, err := s.HandshakeRequest(ctx.Query().Peek("transport"), ctx); err != nil {
+				abortRequest(ctx, asHandshakeError(err))
 			}
 		}
 	}
 
 	s.ApplyMiddlewares(ctx, func(err error) {
 		if err != nil {
-			callback(BAD_REQUEST, map[string]any{"name": "MIDDLEWARE_FAILURE"})
+			callback(&HandshakeError{Code: BAD_REQUEST, Name: "MIDDLEWARE_FAILURE", Err: err})
 		} else {
-			callback(s.Verify(ctx, false))
+			callback(s.VerifyRequest(ctx, false))
 		}
 	})
 
@@ -97,16 +110,27 @@ func (s *server) HandleRequest(ctx *types.HttpContext) {
 
 // Handles an Engine.IO HTTP Upgrade.
 func (s *server) HandleUpgrade(ctx *types.HttpContext) {
-	callback := func(errorCode int, errorContext map[string]any) {
-		if errorContext != nil {
-			s.emitAbortRequest(ctx, errorCode, errorContext)
+	callback := func(err error) {
+		if err != nil {
+			s.emitAbortRequest(ctx, asHandshakeError(err))
 			return
 		}
 
+		upgrader := s.Opts().WebSocketUpgrader()
+		readBufferSize, writeBufferSize := upgrader.ReadBufferSize, upgrader.WriteBufferSize
+		if readBufferSize <= 0 {
+			readBufferSize = 1024
+		}
+		if writeBufferSize <= 0 {
+			writeBufferSize = 1024
+		}
+
 		wsc := types.NewWebSocketConn()
 		ws := &websocket.FastHTTPUpgrader{
-			ReadBufferSize:    1024,
-			WriteBufferSize:   1024,
+			ReadBufferSize:    readBufferSize,
+			WriteBufferSize:   writeBufferSize,
+			WriteBufferPool:   upgrader.WriteBufferPool,
+			Subprotocols:      upgrader.Subprotocols,
 			EnableCompression: s.Opts().PerMessageDeflate() != nil,
 			Error: func(_ *fasthttp.RequestCtx, _ int, reason error) {
 				if websocket.IsUnexpectedCloseError(reason) {
@@ -121,22 +145,32 @@ func (s *server) HandleUpgrade(ctx *types.HttpContext) {
 			},
 		}
 
+		if upgrader.HandshakeTimeout > 0 {
+			// the deadline of the handshake response, the upgrader clearing it once the connection is hijacked
+			ctx.RequestCtx().Conn().SetWriteDeadline(time.Now().Add(upgrader.HandshakeTimeout))
+		}
+
 		// delegate to ws
 		if err := ws.Upgrade(ctx.RequestCtx(), func(conn *websocket.Conn) {
 			conn.SetReadLimit(s.Opts().MaxHttpBufferSize())
+			if upgrader.CompressionLevel != 0 {
+				if err := conn.SetCompressionLevel(upgrader.CompressionLevel); err != nil {
+					server_log.Debug("invalid websocket compression level: %s", err.Error())
+				}
+			}
 			wsc.Conn = conn
 			s.onWebSocket(ctx, wsc)
 		}); err != nil {
-			s.emitAbortRequest(ctx, BAD_REQUEST, map[string]any{"name": "UPGRADE_FAILURE"})
+			s.emitAbortRequest(ctx, &HandshakeError{Code: BAD_REQUEST, Name: "UPGRADE_FAILURE", Err: err})
 			server_log.Debug("websocket error before upgrade: %s", err.Error())
 		}
 	}
 
 	s.ApplyMiddlewares(ctx, func(err error) {
 		if err != nil {
-			callback(BAD_REQUEST, map[string]any{"name": "MIDDLEWARE_FAILURE"})
+			callback(&HandshakeError{Code: BAD_REQUEST, Name: "MIDDLEWARE_FAILURE", Err: err})
 		} else {
-			callback(s.Verify(ctx, true))
+			callback(s.VerifyRequest(ctx, true))
 		}
 	})
 }
@@ -151,7 +185,7 @@ func (s *server) onWebSocket(ctx *types.HttpContext, wsc *types.WebSocketConn) {
 	wsc.On("error", onUpgradeError)
 
 	transportName := ctx.Query().Peek("transport")
-	if transport, ok := transports.Transports()[transportName]; ok && !transport.HandlesUpgrades {
+	if factory, ok := transports.Lookup(transportName); !ok || !factory.HandlesUpgrades {
 		server_log.Debug("transport doesnt handle upgraded requests")
 		wsc.Close()
 		return
@@ -164,8 +198,8 @@ func (s *server) onWebSocket(ctx *types.HttpContext, wsc *types.WebSocketConn) {
 	ctx.Websocket = wsc
 
 	if len(id) == 0 {
-		if errorCode, t := s.Handshake(transportName, ctx); t == nil {
-			abortUpgrade(ctx, errorCode, nil)
+		if _, err := s.HandshakeRequest(transportName, ctx); err != nil {
+			abortUpgrade(ctx, asHandshakeError(err))
 		}
 		<-wsc.Done()
 		return
@@ -193,13 +227,152 @@ func (s *server) onWebSocket(ctx *types.HttpContext, wsc *types.WebSocketConn) {
 			server_log.Debug("upgrading not existing transport")
 			wsc.Close()
 		} else {
-			transport.SetPerMessageDeflate(s.Opts().PerMessageDeflate())
+			configureTransport(transport, s.Opts(), s.Metrics())
 			client.MaybeUpgrade(transport)
 		}
 	}
 	<-wsc.Done()
 }
 
+type webTransportHandshake struct {
+	Sid string `json:"sid" mapstructure:"sid" msgpack:"sid"`
+}
+
+// Handles a WebTransport session request received by the HTTP/3 listener of a *types.HttpServer.
+func (s *server) OnWebTransportSession(ctx *types.HttpContext) {
+	wtr := types.WebTransportRequestFrom(ctx.RequestCtx())
+	if wtr == nil {
+		s.emitAbortRequest(ctx, &HandshakeError{Code: BAD_REQUEST, Name: "UPGRADE_FAILURE"})
+		return
+	}
+
+	s.ApplyMiddlewares(ctx, func(err error) {
+		if err != nil {
+			s.emitAbortRequest(ctx, &HandshakeError{Code: BAD_REQUEST, Name: "MIDDLEWARE_FAILURE", Err: err})
+			return
+		}
+		if err := verifyOrigin(s.Opts(), ctx); err != nil {
+			s.emitAbortRequest(ctx, err)
+			return
+		}
+		if allowRequest := s.Opts().AllowRequest(); allowRequest != nil {
+			if err := allowRequest(ctx); err != nil {
+				s.emitAbortRequest(ctx, &HandshakeError{Code: FORBIDDEN, Message: err.Error(), Err: err})
+				return
+			}
+		}
+		s.onWebTransportSession(ctx, wtr)
+	})
+}
+
+// Called upon an accepted WebTransport session request.
+func (s *server) onWebTransportSession(ctx *types.HttpContext, wtr *types.WebTransportRequest) {
+	session, err := wtr.Upgrade()
+	if err != nil {
+		server_log.Debug("upgrading failed: %s", err.Error())
+		s.emitAbortRequest(ctx, &HandshakeError{Code: BAD_REQUEST, Name: "UPGRADE_FAILURE", Err: err})
+		return
+	}
+
+	timeout := utils.SetTimeout(func() {
+		server_log.Debug("the client failed to establish a bidirectional stream in the given period")
+		session.CloseWithError(0, "")
+	}, s.Opts().UpgradeTimeout())
+
+	stream, err := session.AcceptStream(context.Background())
+	if err != nil {
+		utils.ClearTimeout(timeout)
+		server_log.Debug("session is closed")
+		return
+	}
+
+	wtc := webtrans.NewConn(session, stream, true, 0, 0, nil, nil, nil)
+	wtc.SetReadLimit(s.Opts().MaxHttpBufferSize())
+
+	ctx.WebTransport = wtc
+
+	mt, message, err := wtc.NextReader()
+	if err != nil {
+		utils.ClearTimeout(timeout)
+		server_log.Debug("stream is closed: %s", err.Error())
+		abortUpgrade(ctx, &HandshakeError{Code: BAD_REQUEST})
+		return
+	}
+
+	var data _types.BufferInterface
+
+	switch mt {
+	case webtrans.BinaryMessage:
+		data = _types.NewBytesBuffer(nil)
+	default:
+		data = _types.NewStringBuffer(nil)
+	}
+	_, err = data.ReadFrom(message)
+	if c, ok := message.(io.Closer); ok {
+		c.Close()
+	}
+
+	utils.ClearTimeout(timeout)
+
+	if err != nil {
+		server_log.Debug("WebTransport handshake data read failed: %s", err.Error())
+		abortUpgrade(ctx, &HandshakeError{Code: BAD_REQUEST})
+		return
+	}
+
+	value, err := parser.Parserv4().DecodePacket(data)
+	if err != nil || value.Type != packet.OPEN {
+		server_log.Debug("invalid WebTransport handshake")
+		abortUpgrade(ctx, &HandshakeError{Code: BAD_REQUEST})
+		return
+	}
+
+	if v, ok := value.Data.(io.Closer); ok {
+		defer v.Close()
+	}
+
+	if data, ok := value.Data.(_types.BufferInterface); value.Data == nil || (ok && data.Len() == 0) {
+		// WebTransport is only supported by the v4 protocol
+		ctx.Query().Set("EIO", "4")
+		if _, err := s.HandshakeRequest("webtransport", ctx); err != nil {
+			abortUpgrade(ctx, asHandshakeError(err))
+		}
+		return
+	}
+
+	var wth *webTransportHandshake
+	if json.NewDecoder(value.Data).Decode(&wth) != nil || wth == nil || len(wth.Sid) == 0 {
+		server_log.Debug("invalid WebTransport handshake")
+		abortUpgrade(ctx, &HandshakeError{Code: BAD_REQUEST})
+		return
+	}
+
+	client, ok := s.Clients().Load(wth.Sid)
+
+	if !ok {
+		server_log.Debug("upgrade attempt for closed client")
+		session.CloseWithError(0, "")
+	} else if client.Upgrading() {
+		server_log.Debug("transport has already been trying to upgrade")
+		session.CloseWithError(0, "")
+	} else if client.Upgraded() {
+		server_log.Debug("transport had already been upgraded")
+		session.CloseWithError(0, "")
+	} else {
+		server_log.Debug("upgrading existing transport")
+
+		ctx.Query().Set("EIO", "4")
+		transport, err := s.CreateTransport("webtransport", ctx)
+		if err != nil {
+			server_log.Debug("upgrading not existing transport")
+			session.CloseWithError(0, "")
+		} else {
+			configureTransport(transport, s.Opts(), s.Metrics())
+			client.MaybeUpgrade(transport)
+		}
+	}
+}
+
 // Captures upgrade requests for a types.HttpServer.
 func (s *server) Attach(server *types.HttpServer, opts any) {
 	options, _ := opts.(config.AttachOptionsInterface)
@@ -214,80 +387,88 @@ func (s *server) Attach(server *types.HttpServer, opts any) {
 
 // Captures upgrade requests for a types.RequestHandler, Need to handle server shutdown disconnecting client connections.
 func (s *server) FastHTTP(ctx *fasthttp.RequestCtx) {
-	if !websocket.FastHTTPIsWebSocketUpgrade(ctx) {
+	if types.IsWebTransportUpgrade(ctx) {
+		if s.Opts().Transports().Has("webtransport") {
+			s.OnWebTransportSession(s.resolveRemoteAddress(types.NewHttpContext(ctx)))
+		} else {
+			ctx.Error("Not Implemented", fasthttp.StatusNotImplemented)
+		}
+	} else if !websocket.FastHTTPIsWebSocketUpgrade(ctx) {
 		server_log.Debug(`intercepting request for path "%s"`, utils.CleanPath(strconv.B2S(ctx.Path())))
-		s.HandleRequest(types.NewHttpContext(ctx))
+		c := s.resolveRemoteAddress(types.AcquireHttpContext(ctx))
+		s.HandleRequest(c)
+		// the contexts referenced after their request, e.g. the handshake ones, are retained
+		types.ReleaseHttpContext(c)
 	} else if s.Opts().Transports().Has("websocket") {
-		s.HandleUpgrade(types.NewHttpContext(ctx))
+		s.HandleUpgrade(s.resolveRemoteAddress(types.NewHttpContext(ctx)))
 	} else {
 		ctx.Error("Not Implemented", fasthttp.StatusNotImplemented)
 	}
 }
 
+// Handles the requests of a net/http server, so that the engine can be mounted in a http.ServeMux or any standard
+// router, see types.NewHttpHandler.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.httpHandler.ServeHTTP(w, r)
+}
+
+// Resolves the client address of a request from the headers of the trusted proxies.
+func (s *server) resolveRemoteAddress(c *types.HttpContext) *types.HttpContext {
+	if trustedProxies := s.Opts().TrustedProxies(); len(trustedProxies) > 0 {
+		c.SetRemoteAddress(types.ResolveRemoteAddress(c, trustedProxies))
+	}
+	return c
+}
+
 // Close the HTTP long-polling request
-func abortRequest(ctx *types.HttpContext, errorCode int, errorContext map[string]any) {
-	server_log.Debug("abortRequest %d, %v", errorCode, errorContext)
+func abortRequest(ctx *types.HttpContext, err *HandshakeError) {
+	server_log.Debug("abortRequest %d, %v", err.Code, err)
 	statusCode := fasthttp.StatusBadRequest
-	if errorCode == FORBIDDEN {
+	switch err.Code {
+	case FORBIDDEN:
 		statusCode = fasthttp.StatusForbidden
-	}
-	message := errorMessages[errorCode]
-	if errorContext != nil {
-		if m, ok := errorContext["message"]; ok {
-			message = m.(string)
-		}
+	case SERVICE_UNAVAILABLE:
+		statusCode = fasthttp.StatusServiceUnavailable
+		ctx.ResponseHeaders.Set("Retry-After", retryAfter)
 	}
 	ctx.ResponseHeaders.Set("Content-Type", "application/json")
 	ctx.SetStatusCode(statusCode)
-	if b, err := json.Marshal(types.CodeMessage{Code: errorCode, Message: message}); err == nil {
+	if b, err := json.Marshal(err); err == nil {
 		ctx.Write(b)
 		return
 	}
 	io.WriteString(ctx, `{"code":400,"message":"Bad request"}`)
 }
 
-func (s *server) emitAbortRequest(ctx *types.HttpContext, errorCode int, errorContext map[string]any) {
-	s.Emit("connection_error", &types.ErrorMessage{
-		CodeMessage: &types.CodeMessage{
-			Code:    errorCode,
-			Message: errorMessages[errorCode],
-		},
-		Req:     ctx,
-		Context: errorContext,
-	})
-	abortRequest(ctx, errorCode, errorContext)
+func (s *server) emitAbortRequest(ctx *types.HttpContext, err *HandshakeError) {
+	emitConnectionError(s, ctx, err)
+	abortRequest(ctx, err)
 }
 
 // Close the WebSocket connection
-func abortUpgrade(ctx *types.HttpContext, errorCode int, errorContext map[string]any) {
+func abortUpgrade(ctx *types.HttpContext, err *HandshakeError) {
 	ctx.On("error", func(...any) {
 		server_log.Debug("ignoring error from closed connection")
 	})
 
-	message := errorMessages[errorCode]
-	if errorContext != nil {
-		if m, ok := errorContext["message"]; ok {
-			message = m.(string)
-		}
-	}
+	message := err.message()
 
 	if ctx.Websocket != nil {
 		defer ctx.Websocket.Close()
 		ctx.Websocket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, message))
+	} else if ctx.WebTransport != nil {
+		ctx.WebTransport.CloseWithError(fasthttp.StatusBadRequest, message)
+	} else if err.Code == SERVICE_UNAVAILABLE {
+		ctx.ResponseHeaders.Set("Retry-After", retryAfter)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		io.WriteString(ctx, message)
 	} else {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		io.WriteString(ctx, message)
 	}
 }
 
-func (s *server) emitAbortUpgrade(ctx *types.HttpContext, errorCode int, errorContext map[string]any) {
-	s.Emit("connection_error", &types.ErrorMessage{
-		CodeMessage: &types.CodeMessage{
-			Code:    errorCode,
-			Message: errorMessages[errorCode],
-		},
-		Req:     ctx,
-		Context: errorContext,
-	})
-	abortUpgrade(ctx, errorCode, errorContext)
+func (s *server) emitAbortUpgrade(ctx *types.HttpContext, err *HandshakeError) {
+	emitConnectionError(s, ctx, err)
+	abortUpgrade(ctx, err)
 }
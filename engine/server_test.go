@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io-go-parser/packet"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	e_types "github.com/zishang520/engine.io/v2/types"
+)
+
+func TestServeHTTP(t *testing.T) {
+	engine := NewServer(nil)
+	defer engine.Close()
+	engine.Use(types.HttpMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", r.URL.Query().Get("transport"))
+			w.Header().Add("X-Values", "a")
+			w.Header().Add("X-Values", "b")
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/engine.io/", engine)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+
+	do := func(method, url, body string, authorized bool) (*http.Response, string) {
+		t.Helper()
+
+		req, _ := http.NewRequest(method, httpServer.URL+url, strings.NewReader(body))
+		if authorized {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Do() error = %v", err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	t.Run("middleware", func(t *testing.T) {
+		res, body := do(http.MethodGet, "/engine.io/?EIO=4&transport=polling", "", false)
+		if res.StatusCode != http.StatusUnauthorized || body != "Unauthorized\n" {
+			t.Fatalf("response = %d %q, want match for %d", res.StatusCode, body, http.StatusUnauthorized)
+		}
+		if header := res.Header.Get("X-Middleware"); header != "polling" {
+			t.Fatalf("X-Middleware = %q, want match for %q", header, "polling")
+		}
+		if values := res.Header.Values("X-Values"); strings.Join(values, ",") != "a,b" {
+			t.Fatalf("X-Values = %q, want match for %q", values, []string{"a", "b"})
+		}
+	})
+
+	t.Run("polling", func(t *testing.T) {
+		res, open := do(http.MethodGet, "/engine.io/?EIO=4&transport=polling", "", true)
+		if res.StatusCode != http.StatusOK || !strings.Contains(open, `"sid":"`) {
+			t.Fatalf("response = %d %q, want match for an open packet", res.StatusCode, open)
+		}
+		if header := res.Header.Get("X-Middleware"); header != "polling" {
+			t.Fatalf("X-Middleware = %q, want match for %q", header, "polling")
+		}
+		if values := res.Header.Values("X-Values"); strings.Join(values, ",") != "a,b" {
+			t.Fatalf("X-Values = %q, want match for %q", values, []string{"a", "b"})
+		}
+		socket := <-sockets
+		if !strings.HasPrefix(socket.PeerAddress(), "127.0.0.1:") {
+			t.Fatalf("PeerAddress() = %q, want match for the loopback peer", socket.PeerAddress())
+		}
+
+		messages := make(chan any, 1)
+		socket.On("message", func(args ...any) {
+			messages <- args[0]
+		})
+		url := "/engine.io/?EIO=4&transport=polling&sid=" + socket.Id()
+		if res, body := do(http.MethodPost, url, "4hello", true); res.StatusCode != http.StatusOK || body != "ok" {
+			t.Fatalf("response = %d %q, want match for ok", res.StatusCode, body)
+		}
+		select {
+		case <-messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("socket did not receive the message")
+		}
+
+		socket.Send(strings.NewReader("world"), nil, nil)
+		if _, body := do(http.MethodGet, url, "", true); body != "4world" {
+			t.Fatalf("poll = %q, want match for %q", body, "4world")
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/engine.io/?EIO=4&transport=websocket"
+		if _, res, err := ws.DefaultDialer.Dial(url, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Dial() = %v, want match for a %d response", err, http.StatusUnauthorized)
+		}
+
+		conn, _, err := ws.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer token"}})
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		socket := <-sockets
+
+		if _, open, err := conn.ReadMessage(); err != nil || !strings.Contains(string(open), `"sid":"`+socket.Id()) {
+			t.Fatalf("ReadMessage() = %q, %v, want match for the open packet", open, err)
+		}
+		socket.Send(strings.NewReader("world"), nil, nil)
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "4world" {
+			t.Fatalf("ReadMessage() = %q, %v, want match for %q", message, err, "4world")
+		}
+	})
+}
+
+// Measures the lifecycle of the context of a polling request, from its creation to its response.
+func BenchmarkHttpContext(b *testing.B) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/engine.io/?EIO=4&transport=polling&sid=-ZWcRVyFNL97LAAAAAAAAAAA&t=P1a2b3c")
+	ctx.Request.Header.Set("Host", "localhost:3000")
+	ctx.Request.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)")
+	ctx.Request.Header.Set("Accept", "*/*")
+	ctx.Request.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	ctx.Request.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	ctx.Request.Header.Set("Origin", "http://localhost:3000")
+	ctx.Request.Header.Set("Cookie", "io=-ZWcRVyFNL97LAAAAAAAAAAA")
+
+	handle := func(c *types.HttpContext) {
+		c.Query().Peek("sid")
+		c.Headers().Peek("Origin")
+		c.ResponseHeaders.Set("Content-Type", "text/plain; charset=UTF-8")
+		c.Write([]byte("6"))
+		<-c.Done()
+	}
+
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ctx.Response.Reset()
+			handle(types.NewHttpContext(ctx))
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ctx.Response.Reset()
+			c := types.AcquireHttpContext(ctx)
+			handle(c)
+			types.ReleaseHttpContext(c)
+		}
+	})
+}
+
+// Measures the requests of an open polling session.
+func BenchmarkPolling(b *testing.B) {
+	engine := NewServer(nil)
+	defer engine.Close()
+	engine.On("connection", func(args ...any) {
+		socket := args[0].(Socket)
+		socket.On("message", func(args ...any) {
+			socket.Send(strings.NewReader("pong"), nil, nil)
+		})
+	})
+
+	request := func(method, uri, body string) string {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.Set("Host", "localhost")
+		ctx.Request.SetBodyString(body)
+		engine.FastHTTP(ctx)
+		return string(ctx.Response.Body())
+	}
+
+	open := request(fasthttp.MethodGet, "/engine.io/?EIO=4&transport=polling", "")
+	var handshake struct {
+		Sid string `json:"sid"`
+	}
+	if err := json.Unmarshal([]byte(open[1:]), &handshake); err != nil {
+		b.Fatalf("json.Unmarshal(%q) error = %v", open, err)
+	}
+	uri := "/engine.io/?EIO=4&transport=polling&sid=" + handshake.Sid
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request(fasthttp.MethodPost, uri, "4ping")
+		request(fasthttp.MethodGet, uri, "")
+	}
+}
+
+func TestWebSocketUpgrader(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetPerMessageDeflate(&e_types.PerMessageDeflate{Threshold: 0})
+	opts.SetWebSocketUpgrader(&types.WebSocketUpgrader{
+		ReadBufferSize:   4096,
+		WriteBufferSize:  4096,
+		WriteBufferPool:  &sync.Pool{},
+		Subprotocols:     []string{"v2.example.com", "v1.example.com"},
+		HandshakeTimeout: time.Second,
+		CompressionLevel: 9,
+	})
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	dialer := &ws.Dialer{
+		Subprotocols:      []string{"v1.example.com", "v2.example.com"},
+		EnableCompression: true,
+	}
+	conn, res, err := dialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+
+	// the preference of the server wins
+	if protocol := conn.Subprotocol(); protocol != "v2.example.com" {
+		t.Fatalf(`Subprotocol() = %q, want match for %q`, protocol, "v2.example.com")
+	}
+	if protocol := socket.Request().Websocket.Subprotocol(); protocol != "v2.example.com" {
+		t.Fatalf(`server Subprotocol() = %q, want match for %q`, protocol, "v2.example.com")
+	}
+	if extensions := res.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(extensions, "permessage-deflate") {
+		t.Fatalf(`Sec-WebSocket-Extensions = %q, want match for "permessage-deflate"`, extensions)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	message := strings.Repeat("hello", 1000)
+	socket.Send(strings.NewReader(message), &packet.Options{Compress: true}, nil)
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "4"+message {
+		t.Fatalf("ReadMessage() = %d bytes, %v, want match for %d bytes", len(data), err, len(message)+1)
+	}
+}
@@ -1,9 +1,14 @@
 package engine
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"io"
+	"log/slog"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,13 +16,21 @@ import (
 	_types "github.com/zishang520/engine.io-go-parser/types"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/transports"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	"github.com/zishang520/engine.io/v2/errors"
 	"github.com/zishang520/engine.io/v2/events"
 	"github.com/zishang520/engine.io/v2/log"
 	e_types "github.com/zishang520/engine.io/v2/types"
 	"github.com/zishang520/engine.io/v2/utils"
 )
 
-var socket_log = log.NewLog("engine:socket")
+var (
+	socket_log = log.NewLog("engine:socket")
+
+	// A packet is sent to a socket which is closing or closed.
+	ErrSocketNotOpen = errors.New("socket is not open").Err()
+	// A packet is dropped by the write buffer policy.
+	ErrWriteBufferFull = errors.New("write buffer full").Err()
+)
 
 type socket struct {
 	events.EventEmitter
@@ -26,6 +39,9 @@ type socket struct {
 	// TODO for the next major release: do not keep the reference to the first HTTP request, as it stays in memory
 	request       *types.HttpContext
 	remoteAddress string
+	peerAddress   string
+	// the message packet sent right after the handshake packet
+	initialPacket io.Reader
 
 	readyState atomic.Value
 	transport  atomic.Pointer[transports.Transport]
@@ -42,6 +58,67 @@ type socket struct {
 	cleanupFn         *e_types.Slice[e_types.Callable]
 	pingTimeoutTimer  atomic.Pointer[utils.Timer]
 	pingIntervalTimer atomic.Pointer[utils.Timer]
+
+	// the size of the packet data in writeBuffer, and a channel closed whenever writeBuffer shrinks.
+	bufferedBytes int64
+	bufferChanged chan e_types.Void
+	bufferMu      sync.Mutex
+
+	// the message packets retained for the connection state recovery, history[0] being the one sent at historyOffset.
+	history       []*retainedPacket
+	historyOffset uint64
+	historyMu     sync.Mutex
+
+	// the statistics returned by Stats, heartbeatAt being when the pending heartbeat started.
+	stats       types.SocketStats
+	heartbeatAt time.Time
+	statsMu     sync.Mutex
+}
+
+// A copy of a message packet, which can be sent again.
+type retainedPacket struct {
+	data     []byte
+	binary   bool
+	compress bool
+
+	// the packet which was buffered, so that it can be forgotten if it is dropped.
+	origin *packet.Packet
+}
+
+func (r *retainedPacket) reader() io.Reader {
+	return dataReader(r.data, r.binary)
+}
+
+// Reads the data of a message packet, binary reports whether the parser encodes it as binary data.
+func readData(data io.Reader) (buf []byte, binary bool, err error) {
+	switch data.(type) {
+	case nil:
+		return nil, false, nil
+	case *_types.StringBuffer, *strings.Reader:
+	default:
+		binary = true
+	}
+	buf, err = io.ReadAll(data)
+	if c, ok := data.(io.Closer); ok {
+		c.Close()
+	}
+	return buf, binary, err
+}
+
+// Returns a reader of the data read by readData, which the parser encodes the same way as the original one.
+func dataReader(buf []byte, binary bool) io.Reader {
+	if binary {
+		return bytes.NewReader(buf)
+	}
+	return strings.NewReader(string(buf))
+}
+
+func (r *retainedPacket) packet() *packet.Packet {
+	return &packet.Packet{
+		Type:    packet.MESSAGE,
+		Data:    r.reader(),
+		Options: &packet.Options{Compress: r.compress},
+	}
 }
 
 func (s *socket) Protocol() int {
@@ -60,10 +137,29 @@ func (s *socket) Id() string {
 	return s.id
 }
 
+// The address of the client, resolved from the headers of the trusted proxies if the peer is one.
 func (s *socket) RemoteAddress() string {
 	return s.remoteAddress
 }
 
+// The address of the peer of the request, which is the proxy when the client is behind one.
+func (s *socket) PeerAddress() string {
+	return s.peerAddress
+}
+
+// The number of packets waiting for the transport to be writable.
+func (s *socket) BufferedPackets() int {
+	return s.writeBuffer.Len()
+}
+
+// The size in bytes of the data of the packets waiting for the transport to be writable.
+func (s *socket) BufferedBytes() int64 {
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+
+	return s.bufferedBytes
+}
+
 func (s *socket) Request() *types.HttpContext {
 	return s.request
 }
@@ -101,6 +197,8 @@ func MakeSocket() Socket {
 		packetsFn:      e_types.NewSlice[func(transports.Transport)](),
 		sentCallbackFn: e_types.NewSlice[any](),
 		cleanupFn:      e_types.NewSlice[e_types.Callable](),
+
+		bufferChanged: make(chan e_types.Void),
 	}
 	s.readyState.Store("opening")
 
@@ -109,8 +207,23 @@ func MakeSocket() Socket {
 
 // Client class.
 func NewSocket(id string, server BaseServer, transport transports.Transport, ctx *types.HttpContext, protocol int) Socket {
+	var initialPacket io.Reader
+	if initialPacketFunc := server.Opts().InitialPacketFunc(); initialPacketFunc != nil {
+		var err error
+		if initialPacket, err = initialPacketFunc(ctx); err != nil {
+			socket_log.Debug("error while creating the initial packet: %s", err.Error())
+			initialPacket = nil
+		}
+	}
+
+	return newSocket(id, server, transport, ctx, protocol, initialPacket)
+}
+
+// Client class, with the message packet sent right after the handshake packet.
+func newSocket(id string, server BaseServer, transport transports.Transport, ctx *types.HttpContext, protocol int, initialPacket io.Reader) Socket {
 	s := MakeSocket()
 
+	s.(*socket).initialPacket = initialPacket
 	s.Construct(id, server, transport, ctx, protocol)
 
 	return s
@@ -120,14 +233,12 @@ func (s *socket) Construct(id string, server BaseServer, transport transports.Tr
 	s.id = id
 	s.server = server
 	s.request = ctx
+	ctx.Retain()
 	s.protocol = protocol
 
 	// Cache IP since it might not be in the req later
-	if ctx.Websocket != nil && ctx.Websocket.Conn != nil {
-		s.remoteAddress = ctx.Websocket.RemoteAddr().String()
-	} else {
-		s.remoteAddress = ctx.RequestCtx().RemoteAddr().String()
-	}
+	s.remoteAddress = ctx.RemoteAddress()
+	s.peerAddress = ctx.PeerAddress()
 
 	s.setTransport(transport)
 	s.onOpen()
@@ -137,7 +248,35 @@ func (s *socket) Construct(id string, server BaseServer, transport transports.Tr
 func (s *socket) onOpen() {
 	s.SetReadyState("open")
 
-	// sends an `open` packet
+	s.sendOpenPacket()
+
+	if s.initialPacket != nil {
+		s.sendPacket(packet.MESSAGE, s.initialPacket, nil, nil)
+		s.initialPacket = nil
+	}
+
+	s.logEvent(slog.LevelInfo, "handshake")
+	s.Emit("open")
+
+	s.heartbeat()
+}
+
+// Emits a structured record about the socket to the logger of the server options, if any.
+func (s *socket) logEvent(level slog.Level, msg string, attrs ...slog.Attr) {
+	logger := s.server.Opts().Logger()
+	if logger == nil {
+		return
+	}
+	logger.LogAttrs(context.Background(), level, msg, append([]slog.Attr{
+		slog.String("sid", s.id),
+		slog.String("transport", s.Transport().Name()),
+		slog.String("remote_address", s.remoteAddress),
+		slog.Int("protocol", s.protocol),
+	}, attrs...)...)
+}
+
+// Sends an `open` packet.
+func (s *socket) sendOpenPacket() {
 	s.Transport().SetSid(s.id)
 
 	data, err := json.Marshal(map[string]any{
@@ -156,13 +295,10 @@ func (s *socket) onOpen() {
 		_types.NewStringBuffer(data),
 		nil, nil,
 	)
+}
 
-	if i := s.server.Opts().InitialPacket(); i != nil {
-		s.sendPacket(packet.MESSAGE, i, nil, nil)
-	}
-
-	s.Emit("open")
-
+// Starts the heartbeat mechanism.
+func (s *socket) heartbeat() {
 	if s.protocol == 3 {
 		// in protocol v3, the client sends a ping, and the server answers with a pong
 		s.resetPingTimeout(s.server.Opts().PingInterval() + s.server.Opts().PingTimeout())
@@ -181,6 +317,7 @@ func (s *socket) onPacket(data *packet.Packet) {
 
 	// export packet event
 	socket_log.Debug(`received packet %s`, data.Type)
+	s.recordReceived(data)
 	s.Emit("packet", data)
 
 	// Reset ping timeout on any packet, incoming data is a good sign of
@@ -215,6 +352,11 @@ func (s *socket) onPacket(data *packet.Packet) {
 // Called upon transport error.
 func (s *socket) onError(err any) {
 	socket_log.Debug("transport error %v", err)
+	if e, ok := err.(*errors.Error); ok && e.Description == transports.ErrWriteTimeout {
+		// the client is too slow or gone, which the heartbeat would only notice later
+		s.OnClose("write timeout", err)
+		return
+	}
 	s.OnClose("transport error", err)
 }
 
@@ -255,6 +397,10 @@ func (s *socket) setTransport(transport transports.Transport) {
 
 	s.transport.Store(&transport)
 
+	s.statsMu.Lock()
+	s.stats.Transports = append(s.stats.Transports, types.TransportUsage{Name: transport.Name(), Since: time.Now()})
+	s.statsMu.Unlock()
+
 	transport.Once("error", onError)
 	transport.On("packet", onPacket)
 	transport.On("drain", flush)
@@ -296,12 +442,18 @@ func (s *socket) MaybeUpgrade(transport transports.Transport) {
 		} else if packet.UPGRADE == data.Type && s.ReadyState() != "closed" {
 			socket_log.Debug("got upgrade packet - upgrading")
 			cleanup()
+			previousTransport := s.Transport().Name()
 			s.Transport().Discard()
 
 			s.upgraded.Store(true)
+			s.statsMu.Lock()
+			s.stats.UpgradedAt = time.Now()
+			s.statsMu.Unlock()
 
 			s.clearTransport()
 			s.setTransport(transport)
+			s.server.Metrics().Upgrade(transport.Name())
+			s.logEvent(slog.LevelInfo, "upgrade", slog.String("previous_transport", previousTransport))
 			s.Emit("upgrade", transport)
 			s.flush()
 			if s.ReadyState() == "closing" {
@@ -392,7 +544,7 @@ func (s *socket) clearTransport() {
 }
 
 // Called upon transport considered closed.
-// Possible reasons: `ping timeout`, `client error`, `parse error`,
+// Possible reasons: `ping timeout`, `write timeout`, `client error`, `parse error`,
 // `transport error`, `server close`, `transport close`
 func (s *socket) OnClose(reason string, description ...any) {
 	description = append(description, nil)
@@ -407,7 +559,7 @@ func (s *socket) OnClose(reason string, description ...any) {
 		// clean writeBuffer in defer, so developers can still
 		// grab the writeBuffer on 'close' event
 		defer func() {
-			s.writeBuffer.Clear()
+			s.clearBuffer()
 		}()
 
 		s.packetsFn.Clear()
@@ -415,6 +567,12 @@ func (s *socket) OnClose(reason string, description ...any) {
 		s.sentCallbackFn.Clear()
 
 		s.clearTransport()
+		s.server.Metrics().Disconnection(reason)
+		if description[0] != nil {
+			s.logEvent(slog.LevelInfo, "close", slog.String("reason", reason), slog.Any("error", description[0]))
+		} else {
+			s.logEvent(slog.LevelInfo, "close", slog.String("reason", reason))
+		}
 		s.Emit("close", reason, description[0])
 	}
 }
@@ -470,7 +628,19 @@ func (s *socket) sendPacket(
 	data io.Reader,
 	options *packet.Options,
 	callback func(transports.Transport),
-) {
+) error {
+	return s.queuePacket(packetType, data, options, callback, true)
+}
+
+// Sends a packet, a full write buffer with the WriteBufferBlock policy being waited for only if wait is true, the
+// packet being dropped otherwise.
+func (s *socket) queuePacket(
+	packetType packet.Type,
+	data io.Reader,
+	options *packet.Options,
+	callback func(transports.Transport),
+	wait bool,
+) error {
 
 	if "closing" != s.ReadyState() && "closed" != s.ReadyState() {
 		socket_log.Debug(`sending packet "%s" (%p)`, packetType, data)
@@ -485,10 +655,14 @@ func (s *socket) sendPacket(
 			Options: options,
 		}
 
+		retained := s.retainable(packet)
+
 		// exports packetCreate event
 		s.Emit("packetCreate", packet)
 
-		s.writeBuffer.Push(packet)
+		if !s.bufferPacket(packet, retained, wait) {
+			return ErrWriteBufferFull
+		}
 
 		// add send callback to object, if defined
 		if callback != nil {
@@ -496,14 +670,290 @@ func (s *socket) sendPacket(
 		}
 
 		s.flush()
+
+		return nil
+	}
+
+	return ErrSocketNotOpen
+}
+
+// Copies a message packet for the connection state recovery, nil is returned if it is not retained.
+func (s *socket) retainable(data *packet.Packet) *retainedPacket {
+	if s.server.Opts().ConnectionStateRecovery() == nil || packet.MESSAGE != data.Type {
+		return nil
+	}
+
+	retained := &retainedPacket{compress: data.Options != nil && data.Options.Compress, origin: data}
+	if data.Data != nil {
+		var err error
+		if retained.data, retained.binary, err = readData(data.Data); err != nil {
+			socket_log.Debug("error while retaining a packet: %s", err.Error())
+		}
+		data.Data = retained.reader()
+	}
+	return retained
+}
+
+// Keeps a copy of a buffered message packet for the connection state recovery.
+//
+// It is called with bufferMu held, so that the history is in the order of the write buffer.
+func (s *socket) retain(retained *retainedPacket) {
+	recovery := s.server.Opts().ConnectionStateRecovery()
+	if recovery == nil || retained == nil {
+		return
+	}
+
+	maxBufferedPackets := recovery.MaxBufferedPackets
+	if maxBufferedPackets <= 0 {
+		maxBufferedPackets = 1000
+	}
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	s.history = append(s.history, retained)
+	if over := len(s.history) - maxBufferedPackets; over > 0 {
+		clear(s.history[:over])
+		s.history = s.history[over:]
+		s.historyOffset += uint64(over)
+	}
+}
+
+// Forgets a message packet dropped from the write buffer, which the client never receives, so that the offsets of the
+// packets retained after it keep matching the ones of the client.
+//
+// It is called with bufferMu held.
+func (s *socket) forget(data *packet.Packet) {
+	if s.server.Opts().ConnectionStateRecovery() == nil {
+		return
+	}
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	// the dropped packets are the latest ones
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if s.history[i].origin == data {
+			s.history = slices.Delete(s.history, i, i+1)
+			return
+		}
+	}
+	if s.historyOffset > 0 {
+		// no longer retained, but counted by the offset
+		s.historyOffset--
+	}
+}
+
+// Reports whether the closed socket can be resumed by a client which received the message packets up to offset.
+func (s *socket) Recoverable(offset uint64) bool {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	return "closed" == s.ReadyState() && s.historyOffset <= offset && offset <= s.historyOffset+uint64(len(s.history))
+}
+
+// Resumes the closed socket on the given transport, the message packets sent from offset are sent again.
+func (s *socket) Recover(transport transports.Transport, ctx *types.HttpContext, offset uint64) {
+	socket_log.Debug(`recovering socket "%s" from offset %d`, s.id, offset)
+
+	s.request = ctx
+	ctx.Retain()
+	s.remoteAddress = ctx.RemoteAddress()
+	s.peerAddress = ctx.PeerAddress()
+	s.upgrading.Store(false)
+	s.upgraded.Store(false)
+
+	s.setTransport(transport)
+	s.SetReadyState("open")
+
+	s.sendOpenPacket()
+
+	s.historyMu.Lock()
+	var replay []*packet.Packet
+	if start := offset - s.historyOffset; start < uint64(len(s.history)) {
+		for _, retained := range s.history[start:] {
+			replay = append(replay, retained.packet())
+		}
+	}
+	s.historyMu.Unlock()
+
+	socket_log.Debug("replaying %d packets", len(replay))
+	for _, packet := range replay {
+		s.pushPacket(packet, packetSize(packet))
+	}
+	s.flush()
+
+	s.logEvent(slog.LevelInfo, "recovered", slog.Uint64("offset", offset), slog.Int("replayed", len(replay)))
+	s.Emit("recovered")
+
+	s.heartbeat()
+}
+
+// Returns the size of the packet data, the data is read into memory if its size is unknown.
+func packetSize(data *packet.Packet) int64 {
+	switch v := data.Data.(type) {
+	case nil:
+		return 0
+	case interface{ Len() int }:
+		return int64(v.Len())
+	default:
+		buf, err := io.ReadAll(v)
+		if c, ok := v.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			socket_log.Debug("error while reading a packet: %s", err.Error())
+		}
+		data.Data = bytes.NewReader(buf)
+		return int64(len(buf))
+	}
+}
+
+// Adds a packet to the packets buffer.
+func (s *socket) pushPacket(data *packet.Packet, size int64) {
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+
+	s.writeBuffer.Push(data)
+	s.bufferedBytes += size
+}
+
+// Empties the packets buffer and returns its packets.
+func (s *socket) clearBuffer() []*packet.Packet {
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+
+	wbuf := s.writeBuffer.AllAndClear()
+	s.bufferedBytes = 0
+	close(s.bufferChanged)
+	s.bufferChanged = make(chan e_types.Void)
+
+	return wbuf
+}
+
+// Reports whether a packet of the given size fits in the packets buffer, bufferMu must be held.
+func (s *socket) fits(limits *types.WriteBuffer, size int64) bool {
+	return (limits.MaxPackets <= 0 || s.writeBuffer.Len() < limits.MaxPackets) &&
+		(limits.MaxBytes <= 0 || s.bufferedBytes+size <= limits.MaxBytes)
+}
+
+// Adds a packet to the packets buffer, applying the write buffer policy to the message packets.
+// Returns false if the packet has been dropped, the retained copy being only kept if the packet is buffered.
+//
+// With the WriteBufferBlock policy, the packet is dropped right away if wait is false.
+func (s *socket) bufferPacket(data *packet.Packet, retained *retainedPacket, wait bool) bool {
+	size := packetSize(data)
+
+	limits := s.server.Opts().WriteBuffer()
+	if limits == nil || packet.MESSAGE != data.Type {
+		s.bufferMu.Lock()
+		s.writeBuffer.Push(data)
+		s.bufferedBytes += size
+		s.retain(retained)
+		s.bufferMu.Unlock()
+		return true
+	}
+
+	var deadline <-chan time.Time
+	for {
+		s.bufferMu.Lock()
+		if s.fits(limits, size) {
+			s.writeBuffer.Push(data)
+			s.bufferedBytes += size
+			s.retain(retained)
+			s.bufferMu.Unlock()
+			return true
+		}
+
+		switch limits.Policy {
+		case types.WriteBufferDropOldest:
+			var dropped []*packet.Packet
+			for !s.fits(limits, size) {
+				i := s.writeBuffer.FindIndex(func(p *packet.Packet) bool { return packet.MESSAGE == p.Type })
+				if i < 0 {
+					break
+				}
+				removed, _ := s.writeBuffer.Splice(i, 1)
+				for _, p := range removed {
+					s.bufferedBytes -= packetSize(p)
+					s.forget(p)
+				}
+				dropped = append(dropped, removed...)
+			}
+			fits := s.fits(limits, size)
+			if fits {
+				s.writeBuffer.Push(data)
+				s.bufferedBytes += size
+				s.retain(retained)
+			}
+			s.bufferMu.Unlock()
+
+			for _, p := range dropped {
+				socket_log.Debug("write buffer full, dropping the oldest packet")
+				s.Emit("backpressure", limits.Policy, p)
+			}
+			if !fits {
+				socket_log.Debug("write buffer full, dropping the packet")
+				s.Emit("backpressure", limits.Policy, data)
+			}
+			return fits
+
+		case types.WriteBufferClose:
+			s.bufferMu.Unlock()
+
+			socket_log.Debug("write buffer full, closing the socket")
+			s.Emit("backpressure", limits.Policy, data)
+			s.OnClose("write buffer full")
+			return false
+
+		case types.WriteBufferBlock:
+			changed := s.bufferChanged
+			s.bufferMu.Unlock()
+
+			if !wait {
+				socket_log.Debug("write buffer full, dropping the packet instead of waiting")
+				s.Emit("backpressure", types.WriteBufferDropNewest, data)
+				return false
+			}
+
+			if deadline == nil {
+				socket_log.Debug("write buffer full, waiting for room")
+				s.Emit("backpressure", limits.Policy, data)
+
+				timeout := limits.Timeout
+				if timeout <= 0 {
+					timeout = 5 * time.Second
+				}
+				deadline = time.After(timeout)
+			}
+
+			select {
+			case <-changed:
+				if "closing" == s.ReadyState() || "closed" == s.ReadyState() {
+					return false
+				}
+			case <-deadline:
+				socket_log.Debug("write buffer still full, dropping the packet")
+				return false
+			}
+
+		default:
+			s.bufferMu.Unlock()
+
+			socket_log.Debug("write buffer full, dropping the packet")
+			s.Emit("backpressure", types.WriteBufferDropNewest, data)
+			return false
+		}
 	}
 }
 
 // Attempts to flush the packets buffer.
 func (s *socket) flush() {
 	if "closed" != s.ReadyState() && s.Transport().Writable() {
-		if wbuf := s.writeBuffer.AllAndClear(); len(wbuf) > 0 {
+		if wbuf := s.clearBuffer(); len(wbuf) > 0 {
 			socket_log.Debug("flushing buffer to transport")
+			s.server.Metrics().Flush(s.Transport().Name(), len(wbuf))
+			s.recordSent(wbuf)
 			s.Emit("flush", wbuf)
 			s.server.Emit("flush", s, wbuf)
 			if !s.Transport().SupportsFraming() {
@@ -524,6 +974,76 @@ func (s *socket) flush() {
 	}
 }
 
+// Returns the statistics of the socket.
+func (s *socket) Stats() types.SocketStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	stats := s.stats
+	stats.Transports = slices.Clone(s.stats.Transports)
+	return stats
+}
+
+// Records a packet received from the transport.
+func (s *socket) recordReceived(data *packet.Packet) {
+	size := packetSize(data)
+	now := time.Now()
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.stats.PacketsReceived++
+	s.stats.BytesReceived += uint64(size)
+	s.stats.LastActivity = now
+
+	// in protocol v3 the client pings, the round trip lasting until the server pong is flushed
+	if s.protocol == 3 {
+		if packet.PING == data.Type {
+			s.heartbeatAt = now
+		}
+	} else if packet.PONG == data.Type {
+		s.sampleRTT(now)
+	}
+}
+
+// Records the packets written to the transport.
+func (s *socket) recordSent(packets []*packet.Packet) {
+	now := time.Now()
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	for _, data := range packets {
+		s.stats.PacketsSent++
+		s.stats.BytesSent += uint64(packetSize(data))
+
+		if s.protocol == 3 {
+			if packet.PONG == data.Type {
+				s.sampleRTT(now)
+			}
+		} else if packet.PING == data.Type {
+			s.heartbeatAt = now
+		}
+	}
+	s.stats.LastActivity = now
+}
+
+// Updates the smoothed round-trip time with the pending heartbeat, the same way as TCP (RFC 6298).
+// statsMu must be held.
+func (s *socket) sampleRTT(now time.Time) {
+	if s.heartbeatAt.IsZero() {
+		return
+	}
+	sample := now.Sub(s.heartbeatAt)
+	s.heartbeatAt = time.Time{}
+
+	if s.stats.RTT == 0 {
+		s.stats.RTT = sample
+	} else {
+		s.stats.RTT = (7*s.stats.RTT + sample) / 8
+	}
+}
+
 // Get available upgrades for this socket.
 func (s *socket) getAvailableUpgrades() []string {
 	availableUpgrades := []string{}
@@ -559,8 +1079,22 @@ func (s *socket) Close(discard bool) {
 // Closes the underlying transport.
 func (s *socket) closeTransport(discard bool) {
 	socket_log.Debug("closing the transport (discard? %t)", discard)
+	transport := s.Transport()
 	if discard {
-		s.Transport().Discard()
+		transport.Discard()
+	} else if transport.HandlesUpgrades() && !transport.Writable() {
+		// the flushed packets are still being written to the connection, e.g. by the writer loop of the websocket
+		// transport, which would otherwise close it right away
+		socket_log.Debug("waiting for the transport to write the flushed packets")
+		var once sync.Once
+		closeTransport := func(...any) {
+			once.Do(func() { transport.Close(func() { s.OnClose("forced close") }) })
+		}
+		transport.Once("drain", closeTransport)
+		if transport.Writable() {
+			closeTransport()
+		}
+		return
 	}
-	s.Transport().Close(func() { s.OnClose("forced close") })
+	transport.Close(func() { s.OnClose("forced close") })
 }
@@ -0,0 +1,529 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/fasthttp/websocket"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+)
+
+// Opens a polling session and returns its socket and the url of its subsequent requests.
+func openPolling(t *testing.T, engine Server, addr string) (Socket, string) {
+	t.Helper()
+
+	sockets := make(chan Socket, 1)
+	engine.Once("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+
+	url := "http://" + addr + "/engine.io/?EIO=4&transport=polling"
+	open := poll(t, url)
+	var handshake struct {
+		Sid string `json:"sid"`
+	}
+	if err := json.Unmarshal([]byte(open[1:]), &handshake); err != nil {
+		t.Fatalf("json.Unmarshal(%q) error = %v", open, err)
+	}
+
+	return <-sockets, url + "&sid=" + handshake.Sid
+}
+
+func TestSocketWriteBuffer(t *testing.T) {
+	t.Run("drop oldest", func(t *testing.T) {
+		opts := &config.ServerOptions{}
+		opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 2, Policy: types.WriteBufferDropOldest})
+		engine, addr := listen(t, opts)
+
+		socket, url := openPolling(t, engine, addr)
+
+		var dropped []string
+		socket.On("backpressure", func(args ...any) {
+			dropped = append(dropped, string(args[0].(types.WriteBufferPolicy)))
+		})
+
+		for _, message := range []string{"a", "b", "c"} {
+			socket.Send(strings.NewReader(message), nil, nil)
+		}
+
+		if n := socket.BufferedPackets(); n != 2 {
+			t.Fatalf("Socket.BufferedPackets() = %d, want match for %d", n, 2)
+		}
+		if n := socket.BufferedBytes(); n != 2 {
+			t.Fatalf("Socket.BufferedBytes() = %d, want match for %d", n, 2)
+		}
+		if len(dropped) != 1 || dropped[0] != string(types.WriteBufferDropOldest) {
+			t.Fatalf(`backpressure events = %v, want match for ["drop-oldest"]`, dropped)
+		}
+		if payload := poll(t, url); payload != "4b\x1e4c" {
+			t.Fatalf(`payload = %q, want match for %q`, payload, "4b\x1e4c")
+		}
+		if n := socket.BufferedBytes(); n != 0 {
+			t.Fatalf("Socket.BufferedBytes() = %d, want match for %d", n, 0)
+		}
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		opts := &config.ServerOptions{}
+		opts.SetWriteBuffer(&types.WriteBuffer{MaxBytes: 3})
+		engine, addr := listen(t, opts)
+
+		socket, url := openPolling(t, engine, addr)
+
+		for _, message := range []string{"ab", "c", "d"} {
+			socket.Send(strings.NewReader(message), nil, nil)
+		}
+
+		if payload := poll(t, url); payload != "4ab\x1e4c" {
+			t.Fatalf(`payload = %q, want match for %q`, payload, "4ab\x1e4c")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		opts := &config.ServerOptions{}
+		opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 1, Policy: types.WriteBufferClose})
+		engine, addr := listen(t, opts)
+
+		socket, _ := openPolling(t, engine, addr)
+
+		var reason string
+		socket.On("close", func(args ...any) {
+			reason = args[0].(string)
+		})
+
+		socket.Send(strings.NewReader("a"), nil, nil)
+		socket.Send(strings.NewReader("b"), nil, nil)
+
+		if reason != "write buffer full" {
+			t.Fatalf(`close reason = %q, want match for %q`, reason, "write buffer full")
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		opts := &config.ServerOptions{}
+		opts.SetWriteBuffer(&types.WriteBuffer{MaxPackets: 1, Policy: types.WriteBufferBlock, Timeout: 5 * time.Second})
+		engine, addr := listen(t, opts)
+
+		socket, url := openPolling(t, engine, addr)
+
+		socket.Send(strings.NewReader("a"), nil, nil)
+
+		sent := make(chan struct{})
+		go func() {
+			socket.Send(strings.NewReader("b"), nil, nil)
+			close(sent)
+		}()
+
+		select {
+		case <-sent:
+			t.Fatal("Socket.Send() returned while the write buffer is full")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if payload := poll(t, url); payload != "4a" {
+			t.Fatalf(`payload = %q, want match for %q`, payload, "4a")
+		}
+		<-sent
+		if payload := poll(t, url); payload != "4b" {
+			t.Fatalf(`payload = %q, want match for %q`, payload, "4b")
+		}
+	})
+}
+
+func TestSocketInitialPacket(t *testing.T) {
+	t.Run("reader", func(t *testing.T) {
+		opts := &config.ServerOptions{}
+		opts.SetInitialPacket(strings.NewReader("welcome"))
+		_, addr := listen(t, opts)
+
+		// every client gets the whole packet
+		for i := 0; i < 2; i++ {
+			payload := poll(t, "http://"+addr+"/engine.io/?EIO=4&transport=polling")
+			if _, message, _ := strings.Cut(payload, "\x1e"); message != "4welcome" {
+				t.Fatalf(`initial packet = %q, want match for %q`, message, "4welcome")
+			}
+		}
+	})
+
+	t.Run("func", func(t *testing.T) {
+		opts := &config.ServerOptions{}
+		opts.SetInitialPacketFunc(func(ctx *types.HttpContext) (io.Reader, error) {
+			switch user := ctx.Query().Peek("user"); user {
+			case "":
+				return nil, nil
+			case "nobody":
+				return nil, errors.New("unknown user")
+			default:
+				return strings.NewReader("hello " + user), nil
+			}
+		})
+		_, addr := listen(t, opts)
+
+		url := "http://" + addr + "/engine.io/?EIO=4&transport=polling"
+
+		if _, message, _ := strings.Cut(poll(t, url+"&user=alice"), "\x1e"); message != "4hello alice" {
+			t.Fatalf(`initial packet = %q, want match for %q`, message, "4hello alice")
+		}
+		if payload := poll(t, url); strings.Contains(payload, "\x1e") {
+			t.Fatalf(`payload = %q, want match for a handshake packet only`, payload)
+		}
+		if payload := poll(t, url+"&user=nobody"); !strings.Contains(payload, `"code":3`) {
+			t.Fatalf(`payload = %q, want match for a "Bad request" error`, payload)
+		}
+	})
+}
+
+func TestSocketStats(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetPingInterval(50 * time.Millisecond)
+	engine, addr := listen(t, opts)
+
+	socket, url := openPolling(t, engine, addr)
+
+	// the ping is written once the client polls
+	if payload := poll(t, url); payload != "2" {
+		t.Fatalf(`payload = %q, want match for %q`, payload, "2")
+	}
+	time.Sleep(20 * time.Millisecond)
+	res, err := http.Post(url, "text/plain;charset=UTF-8", strings.NewReader("3"))
+	if err != nil {
+		t.Fatalf("http.Post() error = %v", err)
+	}
+	res.Body.Close()
+
+	stats := socket.Stats()
+	if stats.RTT < 20*time.Millisecond {
+		t.Fatalf("Stats().RTT = %s, want match for at least 20ms", stats.RTT)
+	}
+	// the open packet and the ping, then the pong
+	if stats.PacketsSent != 2 || stats.PacketsReceived != 1 {
+		t.Fatalf("Stats() packets = %d sent, %d received, want match for 2 sent, 1 received", stats.PacketsSent, stats.PacketsReceived)
+	}
+	if stats.BytesSent == 0 || stats.LastActivity.IsZero() {
+		t.Fatalf("Stats() = %+v, want match for the sent bytes and the last activity", stats)
+	}
+	if len(stats.Transports) != 1 || stats.Transports[0].Name != "polling" || !stats.UpgradedAt.IsZero() {
+		t.Fatalf("Stats().Transports = %+v, want match for a single polling transport", stats.Transports)
+	}
+}
+
+func TestSocketStatsEIO3(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetAllowEIO3(true)
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.Once("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	poll(t, "http://"+addr+"/engine.io/?EIO=3&transport=polling")
+	socket := <-sockets
+	url := "http://" + addr + "/engine.io/?EIO=3&transport=polling&sid=" + socket.Id()
+
+	// the client pings, the server pongs
+	res, err := http.Post(url, "text/plain;charset=UTF-8", strings.NewReader("1:2"))
+	if err != nil {
+		t.Fatalf("http.Post() error = %v", err)
+	}
+	res.Body.Close()
+	// the pong is flushed by the next poll
+	time.Sleep(50 * time.Millisecond)
+	if payload := poll(t, url); payload != "1:3" {
+		t.Fatalf(`payload = %q, want match for %q`, payload, "1:3")
+	}
+
+	if stats := socket.Stats(); stats.RTT < 50*time.Millisecond || stats.PacketsReceived != 1 {
+		t.Fatalf("Stats() = %+v, want match for an RTT of 50ms at least and 1 received packet", stats)
+	}
+}
+
+// A writer collecting the JSON log records.
+type logRecords struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logRecords) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logRecords) records(t *testing.T) (records []map[string]any) {
+	t.Helper()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSpace(l.buf.String()), "\n") {
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("json.Unmarshal(%q) error = %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSocketLogger(t *testing.T) {
+	output := &logRecords{}
+	opts := &config.ServerOptions{}
+	opts.SetLogger(slog.New(slog.NewJSONHandler(output, nil)))
+	engine, addr := listen(t, opts)
+
+	socket, url := openPolling(t, engine, addr)
+	poll(t, "http://"+addr+"/engine.io/?EIO=4&transport=unknown")
+	socket.Close(false)
+	// the close packet is sent on the next poll
+	poll(t, url)
+
+	records := output.records(t)
+	if len(records) != 3 {
+		t.Fatalf("records = %v, want match for 3 records", records)
+	}
+	for i, want := range []map[string]any{
+		{"msg": "handshake", "sid": socket.Id(), "transport": "polling", "protocol": float64(4)},
+		{"msg": "connection error", "code": float64(UNKNOWN_TRANSPORT), "transport": "unknown"},
+		{"msg": "close", "sid": socket.Id(), "reason": "forced close"},
+	} {
+		for key, value := range want {
+			if records[i][key] != value {
+				t.Fatalf("records[%d][%q] = %v, want match for %v", i, key, records[i][key], value)
+			}
+		}
+	}
+	if records[0]["remote_address"] == "" {
+		t.Fatalf("records[0] = %v, want match for a remote address", records[0])
+	}
+}
+
+func TestSocketRemoteAddress(t *testing.T) {
+	handshake := func(t *testing.T, engine Server, addr string, header http.Header) Socket {
+		t.Helper()
+
+		sockets := make(chan Socket, 1)
+		engine.Once("connection", func(args ...any) {
+			sockets <- args[0].(Socket)
+		})
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/engine.io/?EIO=4&transport=polling", nil)
+		req.Header = header
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Do() error = %v", err)
+		}
+		res.Body.Close()
+		return <-sockets
+	}
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		engine, addr := listen(t, nil)
+
+		socket := handshake(t, engine, addr, http.Header{"X-Forwarded-For": {"203.0.113.7"}})
+		if socket.RemoteAddress() != socket.PeerAddress() || !strings.HasPrefix(socket.PeerAddress(), "127.0.0.1:") {
+			t.Fatalf("RemoteAddress() = %q, PeerAddress() = %q, want match for the peer", socket.RemoteAddress(), socket.PeerAddress())
+		}
+	})
+
+	opts := &config.ServerOptions{}
+	opts.SetTrustedProxies([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")})
+	engine, addr := listen(t, opts)
+
+	for _, test := range []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{"X-Forwarded-For": {"203.0.113.7, 10.0.0.1"}}, "203.0.113.7"},
+		{http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"}}, "203.0.113.7"},
+		{http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.1`}, "X-Forwarded-For": {"203.0.113.7"}}, "2001:db8::1"},
+		{http.Header{"X-Real-IP": {"203.0.113.7"}}, "203.0.113.7"},
+		{http.Header{"X-Forwarded-For": {"unknown, 10.0.0.1"}}, "10.0.0.1"},
+	} {
+		socket := handshake(t, engine, addr, test.header)
+		if socket.RemoteAddress() != test.want {
+			t.Fatalf("RemoteAddress() = %q, want match for %q with %v", socket.RemoteAddress(), test.want, test.header)
+		}
+		if !strings.HasPrefix(socket.PeerAddress(), "127.0.0.1:") {
+			t.Fatalf("PeerAddress() = %q, want match for the loopback peer", socket.PeerAddress())
+		}
+	}
+}
+
+func TestSocketWebSocketWriter(t *testing.T) {
+	engine, addr := listen(t, nil)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	drained := make(chan struct{}, 1)
+	socket.On("drain", func(...any) {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	})
+
+	// the peer does not read, so that the socket buffers fill up
+	const count, size = 64, 256 << 10
+	message := strings.Repeat("a", size)
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Send() took %v, want the writes not to block the caller", elapsed)
+	}
+
+	for i := 0; i < count; i++ {
+		if _, data, err := conn.ReadMessage(); err != nil || len(data) != size+1 {
+			t.Fatalf("ReadMessage() = %d bytes, %v, want match for %d bytes", len(data), err, size+1)
+		}
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`socket did not emit "drain"`)
+	}
+}
+
+func TestSocketWebSocketWriteTimeout(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetWriteTimeout(200 * time.Millisecond)
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+
+	reasons := make(chan string, 1)
+	socket.On("close", func(args ...any) {
+		reasons <- args[0].(string)
+	})
+
+	// the peer does not read, so that a write ends up blocked
+	message := strings.Repeat("a", 256<<10)
+	for i := 0; i < 64; i++ {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != "write timeout" {
+			t.Fatalf(`close reason = %q, want match for %q`, reason, "write timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`socket did not emit "close"`)
+	}
+	if count := engine.Metrics().Disconnections("write timeout"); count != 1 {
+		t.Fatalf(`Disconnections("write timeout") = %d, want match for 1`, count)
+	}
+	if count := engine.Metrics().Disconnections("ping timeout"); count != 0 {
+		t.Fatalf(`Disconnections("ping timeout") = %d, want match for 0`, count)
+	}
+}
+
+func TestSocketWebSocketFrames(t *testing.T) {
+	engine, addr := listen(t, nil)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	// the lengths around the boundaries of the frame header, written by the same passes
+	sizes := []int{0, 1, 124, 125, 126, 0xffff - 1, 0xffff, 0x10000, 100_000}
+	for _, size := range sizes {
+		socket.Send(strings.NewReader(strings.Repeat("a", size)), nil, nil)
+	}
+	socket.Send(bytes.NewReader([]byte{1, 2, 3}), nil, nil)
+	// the queued packets are written before the connection is closed
+	socket.Close(false)
+
+	for _, size := range sizes {
+		if mt, data, err := conn.ReadMessage(); err != nil || mt != ws.TextMessage || len(data) != size+1 {
+			t.Fatalf("ReadMessage() = %d, %d bytes, %v, want match for a text message of %d bytes", mt, len(data), err, size+1)
+		}
+	}
+	if mt, data, err := conn.ReadMessage(); err != nil || mt != ws.BinaryMessage || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Fatalf("ReadMessage() = %d, %v, %v, want match for a binary message [1 2 3]", mt, data, err)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() error = nil, want match for the closed connection")
+	}
+}
+
+func TestSocketWebSocketForcedClose(t *testing.T) {
+	opts := &config.ServerOptions{}
+	// the writes never time out
+	opts.SetWriteTimeout(0)
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+	conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	socket := <-sockets
+
+	reasons := make(chan string, 1)
+	socket.On("close", func(args ...any) {
+		reasons <- args[0].(string)
+	})
+
+	// the peer does not read, so that a write ends up blocked
+	message := strings.Repeat("a", 256<<10)
+	for i := 0; i < 64; i++ {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	socket.Close(true)
+	select {
+	case reason := <-reasons:
+		if reason != "forced close" {
+			t.Fatalf(`close reason = %q, want match for %q`, reason, "forced close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`socket did not emit "close" while a write was blocked`)
+	}
+}
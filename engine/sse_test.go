@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/fasthttp/websocket"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
+	_types "github.com/zishang520/engine.io/v2/types"
+)
+
+// Reads the next event of a Server-Sent Events stream and returns the packet it carries.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString() error = %v", err)
+		}
+		if data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "data: "); ok {
+			var packet string
+			if err := json.Unmarshal([]byte(data), &packet); err != nil {
+				t.Fatalf("json.Unmarshal(%q) error = %v", data, err)
+			}
+			return packet
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetTransports(_types.NewSet("polling", "sse", "websocket"))
+
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	messages := make(chan string, 2)
+	engine.On("connection", func(args ...any) {
+		socket := args[0].(Socket)
+		socket.On("message", func(args ...any) {
+			messages <- args[0].(interface{ String() string }).String()
+		})
+		sockets <- socket
+	})
+
+	url := "http://" + addr + "/engine.io/?EIO=4&transport=sse"
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	defer res.Body.Close()
+
+	if contentType := res.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		t.Fatalf(`Content-Type = %q, want match for "text/event-stream"`, contentType)
+	}
+
+	stream := bufio.NewReader(res.Body)
+	open := readEvent(t, stream)
+	if !strings.HasPrefix(open, "0{") {
+		t.Fatalf(`open packet = %q, want match for "0{...}"`, open)
+	}
+	var handshake struct {
+		Sid      string   `json:"sid"`
+		Upgrades []string `json:"upgrades"`
+	}
+	if err := json.Unmarshal([]byte(open[1:]), &handshake); err != nil {
+		t.Fatal(err)
+	}
+	if len(handshake.Upgrades) != 1 || handshake.Upgrades[0] != "websocket" {
+		t.Fatalf(`upgrades = %v, want match for ["websocket"]`, handshake.Upgrades)
+	}
+
+	socket := <-sockets
+
+	t.Run("send", func(t *testing.T) {
+		socket.Send(strings.NewReader("hello\nworld"), nil, nil)
+		if message := readEvent(t, stream); message != "4hello\nworld" {
+			t.Fatalf(`message = %q, want match for %q`, message, "4hello\nworld")
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		res, err := http.Post(url+"&sid="+handshake.Sid, "text/plain;charset=UTF-8", strings.NewReader("4hi\x1e4there"))
+		if err != nil {
+			t.Fatalf("http.Post() error = %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("StatusCode = %d, want match for %d", res.StatusCode, http.StatusOK)
+		}
+		for _, want := range []string{"hi", "there"} {
+			if message := <-messages; message != want {
+				t.Fatalf(`message = %q, want match for %q`, message, want)
+			}
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/engine.io/?EIO=4&transport=websocket&sid="+handshake.Sid, nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+
+		if err := conn.WriteMessage(ws.TextMessage, []byte("2probe")); err != nil {
+			t.Fatal(err)
+		}
+		if _, probe, err := conn.ReadMessage(); err != nil || string(probe) != "3probe" {
+			t.Fatalf(`ReadMessage() = %q, %v, want match for "3probe"`, probe, err)
+		}
+
+		upgraded := make(chan string, 1)
+		socket.Once("upgrade", func(args ...any) {
+			upgraded <- socket.Transport().Name()
+		})
+		if err := conn.WriteMessage(ws.TextMessage, []byte("5")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case name := <-upgraded:
+			if name != "websocket" {
+				t.Fatalf(`Socket.Transport().Name() = %q, want match for %q`, name, "websocket")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the upgrade")
+		}
+
+		socket.Send(strings.NewReader("over websocket"), nil, nil)
+		if _, message, err := conn.ReadMessage(); err != nil || string(message) != "4over websocket" {
+			t.Fatalf(`ReadMessage() = %q, %v, want match for "4over websocket"`, message, err)
+		}
+
+		// the discarded transport ends the stream
+		if rest, err := io.ReadAll(stream); err != nil || strings.Contains(string(rest), "data:") {
+			t.Fatalf(`io.ReadAll() = %q, %v, want match for the end of the stream`, rest, err)
+		}
+	})
+}
+
+func TestSSEBackpressure(t *testing.T) {
+	opts := &config.ServerOptions{}
+	opts.SetTransports(_types.NewSet("sse"))
+	engine, addr := listen(t, opts)
+
+	sockets := make(chan Socket, 1)
+	engine.On("connection", func(args ...any) {
+		sockets <- args[0].(Socket)
+	})
+
+	res, err := http.Get("http://" + addr + "/engine.io/?EIO=4&transport=sse")
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	defer res.Body.Close()
+	stream := bufio.NewReader(res.Body)
+	readEvent(t, stream)
+	socket := <-sockets
+
+	drained := make(chan struct{}, 1)
+	socket.On("drain", func(...any) {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	})
+
+	// the client does not read, the packets are kept by the socket once the stream is stalled
+	const count, size = 64, 256 << 10
+	message := strings.Repeat("a", size)
+	for i := 0; i < count; i++ {
+		socket.Send(strings.NewReader(message), nil, nil)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for socket.BufferedPackets() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Socket.BufferedPackets() = 0, want the packets to be buffered by the socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < count; i++ {
+		if event := readEvent(t, stream); len(event) != size+1 {
+			t.Fatalf("event = %d bytes, want match for %d bytes", len(event), size+1)
+		}
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`socket did not emit "drain"`)
+	}
+}
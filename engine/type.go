@@ -1,7 +1,9 @@
 package engine
 
 import (
+	"context"
 	"io"
+	"net/http"
 
 	"github.com/zishang520/engine.io-go-parser/packet"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
@@ -50,14 +52,28 @@ type (
 		Upgrades(string) *e_types.Set[string]
 		// @protected
 		// Verifies a request.
+		//
+		// Deprecated: use VerifyRequest, which returns a *HandshakeError.
 		Verify(*types.HttpContext, bool) (int, map[string]any)
+		// @protected
+		// Verifies a request, returns a *HandshakeError if it is rejected.
+		VerifyRequest(*types.HttpContext, bool) error
 		// Adds a new middleware.
 		Use(Middleware)
 		// @protected
 		// Apply the middlewares to the request.
 		ApplyMiddlewares(*types.HttpContext, func(error))
+		// Sends a message packet to all the open clients, returns the delivery failures by client id.
+		Broadcast(io.Reader, *packet.Options) map[string]error
+		// Sends a message packet to all the open clients but the given ones, returns the delivery failures by client id.
+		BroadcastExcept(io.Reader, *packet.Options, ...string) map[string]error
+		// The collector of the engine metrics, a types.Handler serving them in the Prometheus text format.
+		Metrics() *types.Metrics
 		// Closes all clients.
 		Close() BaseServer
+		// Stops accepting handshakes and lets the clients drain until the context is done,
+		// returns the number of clients which had to be closed right away. The server cannot be reused afterwards.
+		Shutdown(context.Context) (int, error)
 		// @protected
 		// @abstract
 		Cleanup()
@@ -66,8 +82,13 @@ type (
 		GenerateId(*types.HttpContext) (string, error)
 		// @protected
 		// Handshakes a new client.
+		//
+		// Deprecated: use HandshakeRequest, which returns a *HandshakeError.
 		Handshake(string, *types.HttpContext) (int, transports.Transport)
 		// @protected
+		// Handshakes a new client, returns a *HandshakeError if it is rejected.
+		HandshakeRequest(string, *types.HttpContext) (transports.Transport, error)
+		// @protected
 		// @abstract
 		CreateTransport(string, *types.HttpContext) (transports.Transport, error)
 	}
@@ -76,6 +97,7 @@ type (
 		// #extends
 
 		types.Handler
+		http.Handler
 		BaseServer
 
 		// #setters
@@ -93,6 +115,8 @@ type (
 		HandleRequest(*types.HttpContext)
 		// Handles an Engine.IO HTTP Upgrade.
 		HandleUpgrade(*types.HttpContext)
+		// Handles a WebTransport session request.
+		OnWebTransportSession(*types.HttpContext)
 		// Captures upgrade requests for a *types.HttpServer.
 		Attach(*types.HttpServer, any)
 	}
@@ -110,10 +134,19 @@ type (
 
 		Protocol() int
 		Request() *types.HttpContext
+		// The address of the client, resolved from the headers of the trusted proxies if the peer is one.
 		RemoteAddress() string
+		// The address of the peer of the request, which is the proxy when the client is behind one.
+		PeerAddress() string
 		Transport() transports.Transport
 		Id() string
 		ReadyState() string
+		// The number of packets waiting for the transport to be writable.
+		BufferedPackets() int
+		// The size in bytes of the data of the packets waiting for the transport to be writable.
+		BufferedBytes() int64
+		// The packet and byte counts, the transports used and the heartbeat round-trip time of the socket.
+		Stats() types.SocketStats
 		// @private
 		Upgraded() bool
 		// @private
@@ -125,10 +158,19 @@ type (
 		// @private
 		// Upgrades socket to the given transport
 		MaybeUpgrade(transports.Transport)
+		// @private
+		// Reports whether the closed socket can be resumed by a client which received the message packets up to the offset.
+		Recoverable(uint64) bool
+		// @private
+		// Resumes the closed socket on the given transport, the message packets sent from the offset are sent again.
+		Recover(transports.Transport, *types.HttpContext, uint64)
 		// Sends a message packet.
 		Send(io.Reader, *packet.Options, func(transports.Transport)) Socket
 		Write(io.Reader, *packet.Options, func(transports.Transport)) Socket
 		// Closes the socket and underlying transport.
 		Close(bool)
+		// @private
+		// Called upon transport considered closed.
+		OnClose(string, ...any)
 	}
 )
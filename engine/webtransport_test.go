@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/config"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	_types "github.com/zishang520/engine.io/v2/types"
+	webtrans "github.com/zishang520/engine.io/v2/webtransport"
+)
+
+// Writes a self-signed certificate for 127.0.0.1 and the given host names, and returns the paths of the certificate
+// and key files.
+func selfSignedCert(t *testing.T, names ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestWebTransportHandshake(t *testing.T) {
+	certFile, keyFile := selfSignedCert(t)
+
+	opts := &config.ServerOptions{}
+	opts.SetTransports(_types.NewSet("polling", "websocket", "webtransport"))
+
+	var addr string
+	var listenErr any
+	httpServer := types.NewWebServer(nil)
+	httpServer.Once("error", func(errs ...any) {
+		listenErr = errs[0]
+	})
+	httpServer.Once("listening", func(args ...any) {
+		addr = args[0].(net.Addr).String()
+	})
+	httpServer.ListenWebTransportTLS("127.0.0.1:0", certFile, keyFile, nil, nil)
+	defer httpServer.Close(nil)
+
+	if listenErr != nil {
+		t.Skipf("udp is not available: %v", listenErr)
+	}
+
+	engine := Attach(httpServer, opts)
+
+	messages := make(chan string, 1)
+	engine.On("connection", func(sockets ...any) {
+		socket := sockets[0].(Socket)
+		if name := socket.Transport().Name(); name != "webtransport" {
+			t.Errorf(`Socket.Transport().Name() = %q, want match for %q`, name, "webtransport")
+		}
+		socket.On("message", func(args ...any) {
+			data := new(strings.Builder)
+			if r, ok := args[0].(interface{ String() string }); ok {
+				data.WriteString(r.String())
+			}
+			messages <- data.String()
+			socket.Send(strings.NewReader("pong"), nil, nil)
+		})
+	})
+
+	dialer := &webtransport.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer dialer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, session, err := dialer.Dial(ctx, "https://"+addr+"/engine.io/?EIO=4&transport=webtransport", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer session.CloseWithError(0, "")
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync() error = %v", err)
+	}
+	wtc := webtrans.NewConn(session, stream, false, 0, 0, nil, nil, nil)
+
+	if err := wtc.WriteMessage(webtrans.TextMessage, []byte("0")); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	_, open, err := wtc.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if !strings.HasPrefix(string(open), `0{`) || !strings.Contains(string(open), `"sid"`) {
+		t.Fatalf(`open packet = %q, want match for "0{...}"`, open)
+	}
+
+	if err := wtc.WriteMessage(webtrans.TextMessage, []byte("4ping")); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	select {
+	case message := <-messages:
+		if message != "ping" {
+			t.Fatalf(`message = %q, want match for %q`, message, "ping")
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for the message")
+	}
+
+	_, reply, err := wtc.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(reply) != "4pong" {
+		t.Fatalf(`reply = %q, want match for %q`, reply, "4pong")
+	}
+}
+
+func TestWebTransportListenError(t *testing.T) {
+	dir := t.TempDir()
+
+	var listenErr any
+	listening := false
+	httpServer := types.NewWebServer(nil)
+	httpServer.Once("error", func(errs ...any) {
+		listenErr = errs[0]
+	})
+	httpServer.Once("listening", func(...any) {
+		listening = true
+	})
+	called := false
+	httpServer.ListenWebTransportTLS("127.0.0.1:0", filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), nil, func() {
+		called = true
+	})
+	defer httpServer.Close(nil)
+
+	if listenErr == nil {
+		t.Fatal(`ListenWebTransportTLS() did not emit "error" for a missing certificate`)
+	}
+	if listening || called {
+		t.Fatalf(`ListenWebTransportTLS() listening = %t, called = %t, want neither`, listening, called)
+	}
+}
@@ -5,6 +5,8 @@ go 1.22.2
 require (
 	github.com/andybalholm/brotli v1.1.0
 	github.com/fasthttp/websocket v1.5.9
+	github.com/quic-go/quic-go v0.44.0
+	github.com/quic-go/webtransport-go v0.8.0
 	github.com/savsgio/gotils v0.0.0-20240303185622-093b76447511
 	github.com/valyala/fasthttp v1.54.0
 	github.com/zishang520/engine.io-go-parser v1.2.5
@@ -19,8 +21,6 @@ require (
 	github.com/klauspost/compress v1.17.8 // indirect
 	github.com/onsi/ginkgo/v2 v2.12.0 // indirect
 	github.com/quic-go/qpack v0.4.0 // indirect
-	github.com/quic-go/quic-go v0.44.0 // indirect
-	github.com/quic-go/webtransport-go v0.8.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
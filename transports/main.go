@@ -5,26 +5,92 @@ import (
 	_types "github.com/zishang520/engine.io/v2/types"
 )
 
-type transports struct {
-	New             func(*types.HttpContext) Transport
+// TransportFactory describes how the server creates and upgrades a registered transport.
+type TransportFactory struct {
+	// Creates the transport for the request.
+	New func(*types.HttpContext) Transport
+	// Whether the transport is established through a websocket upgrade request.
 	HandlesUpgrades bool
-	UpgradesTo      *_types.Set[string]
+	// Whether the transport is established through its own session, e.g. a WebTransport session over HTTP/3, rather
+	// than through the HTTP requests.
+	HandlesSessions bool
+	// The transports a client may upgrade to from this transport.
+	UpgradesTo *_types.Set[string]
 }
 
-var _transports map[string]*transports
+var _transports _types.Map[string, *TransportFactory]
 
 func init() {
-	_transports = map[string]*transports{
-		"websocket": {
-			New: func(ctx *types.HttpContext) Transport {
-				return NewWebSocket(ctx)
-			},
-			HandlesUpgrades: true,
-			UpgradesTo:      _types.NewSet[string](),
+	Register("polling", &TransportFactory{
+		// Polling polymorphic New.
+		New: func(ctx *types.HttpContext) Transport {
+			if ctx.Query().Has("j") {
+				return NewJSONP(ctx)
+			}
+			return NewPolling(ctx)
 		},
+		HandlesUpgrades: false,
+		UpgradesTo:      _types.NewSet("websocket", "webtransport"),
+	})
+
+	Register("sse", &TransportFactory{
+		New: func(ctx *types.HttpContext) Transport {
+			return NewSSE(ctx)
+		},
+		HandlesUpgrades: false,
+		UpgradesTo:      _types.NewSet("websocket", "webtransport"),
+	})
+
+	Register("websocket", &TransportFactory{
+		New: func(ctx *types.HttpContext) Transport {
+			return NewWebSocket(ctx)
+		},
+		HandlesUpgrades: true,
+		UpgradesTo:      _types.NewSet("webtransport"),
+	})
+
+	Register("webtransport", &TransportFactory{
+		New: func(ctx *types.HttpContext) Transport {
+			return NewWebTransport(ctx)
+		},
+		HandlesUpgrades: true,
+		HandlesSessions: true,
+		UpgradesTo:      _types.NewSet[string](),
+	})
+}
+
+// Registers a transport under the given name, replacing any transport previously registered with that name.
+// The transport still has to be enabled through the "transports" server option.
+// It is safe to call concurrently, but should usually be done before the server is attached.
+func Register(name string, factory *TransportFactory) {
+	if name == "" {
+		panic("transports: Register name is empty")
+	}
+	if factory == nil || factory.New == nil {
+		panic("transports: Register factory is nil for " + name)
 	}
+	if factory.UpgradesTo == nil {
+		factory.UpgradesTo = _types.NewSet[string]()
+	}
+	_transports.Store(name, factory)
+}
+
+// Removes the transport registered under the given name.
+func Unregister(name string) {
+	_transports.Delete(name)
+}
+
+// Returns the transport registered under the given name.
+func Lookup(name string) (*TransportFactory, bool) {
+	return _transports.Load(name)
 }
 
-func Transports() map[string]*transports {
-	return _transports
+// Returns a snapshot of the registered transports.
+func Transports() map[string]*TransportFactory {
+	transports := map[string]*TransportFactory{}
+	_transports.Range(func(name string, factory *TransportFactory) bool {
+		transports[name] = factory
+		return true
+	})
+	return transports
 }
@@ -0,0 +1,59 @@
+package transports
+
+import (
+	"testing"
+
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+)
+
+func TestRegister(t *testing.T) {
+	t.Run("builtin", func(t *testing.T) {
+		for _, name := range []string{"polling", "sse", "websocket", "webtransport"} {
+			if _, ok := Lookup(name); !ok {
+				t.Fatalf(`Lookup(%q) = false, want match for true`, name)
+			}
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		Register("custom", &TransportFactory{
+			New: func(ctx *types.HttpContext) Transport {
+				return NewPolling(ctx)
+			},
+		})
+		defer Unregister("custom")
+
+		factory, ok := Lookup("custom")
+		if !ok {
+			t.Fatalf(`Lookup(%q) = false, want match for true`, "custom")
+		}
+		if factory.UpgradesTo == nil || factory.UpgradesTo.Len() != 0 {
+			t.Fatalf(`TransportFactory.UpgradesTo = %v, want match for an empty set`, factory.UpgradesTo)
+		}
+		if _, ok := Transports()["custom"]; !ok {
+			t.Fatalf(`Transports()[%q] is missing`, "custom")
+		}
+	})
+
+	t.Run("unregister", func(t *testing.T) {
+		Register("custom", &TransportFactory{
+			New: func(ctx *types.HttpContext) Transport {
+				return NewPolling(ctx)
+			},
+		})
+		Unregister("custom")
+
+		if _, ok := Lookup("custom"); ok {
+			t.Fatalf(`Lookup(%q) = true, want match for false`, "custom")
+		}
+	})
+
+	t.Run("nil factory", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Register() with a nil factory did not panic")
+			}
+		}()
+		Register("custom", nil)
+	})
+}
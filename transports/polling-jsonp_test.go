@@ -0,0 +1,110 @@
+package transports
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zishang520/engine.io-go-parser/packet"
+)
+
+func newTestJSONP(uri string) Jsonp {
+	transport := NewJSONP(newContext(uri))
+	transport.SetMaxHttpBufferSize(1e6)
+	return transport
+}
+
+func TestJSONP(t *testing.T) {
+	const uri = "http://engine.io/engine.io/?EIO=3&transport=polling&j=3"
+
+	t.Run("factory", func(t *testing.T) {
+		factory, _ := Lookup("polling")
+		if _, ok := factory.New(newContext(uri)).(Jsonp); !ok {
+			t.Fatal(`TransportFactory.New() with "j" is not a Jsonp transport`)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		transport := newTestJSONP(uri)
+		client := serve(t, transport)
+		drain := onEvent(transport, "drain")
+
+		responses := request(client, http.MethodGet, uri, "", nil)
+		awaitEvent(t, drain, "drain")
+		transport.Send([]*packet.Packet{
+			{Type: packet.MESSAGE, Data: strings.NewReader("\"hi\"\n</script>")},
+		})
+
+		// the payload is a javascript string, the quotes, newlines and tags escaped
+		want := `___eio[3]("15:4\"hi\"\n\u003c/script\u003e");`
+		if res := await(t, responses); res.status != http.StatusOK || res.body != want {
+			t.Fatalf("response = %d, %q, want match for %d, %q", res.status, res.body, http.StatusOK, want)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		transport := newTestJSONP(uri)
+		client := serve(t, transport)
+		packets := onEvent(transport, "packet")
+
+		// the client sends the newlines as \n, and the escaped ones as \\n
+		for _, tt := range []struct {
+			d    string
+			want string
+		}{
+			{`4:4a\nb`, "a\nb"},
+			{`5:4a\\nb`, `a\nb`},
+		} {
+			body := "d=" + url.QueryEscape(tt.d)
+			res := await(t, request(client, http.MethodPost, uri, body, http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}))
+			if res.status != http.StatusOK || res.body != "ok" {
+				t.Fatalf("response = %d, %q, want match for %d, %q", res.status, res.body, http.StatusOK, "ok")
+			}
+			p := awaitEvent(t, packets, "packet")[0].(*packet.Packet)
+			if data, _ := io.ReadAll(p.Data); p.Type != packet.MESSAGE || string(data) != tt.want {
+				t.Fatalf("packet of %q = %s %q, want match for a message %q", tt.d, p.Type, data, tt.want)
+			}
+		}
+	})
+
+	t.Run("post without data", func(t *testing.T) {
+		transport := newTestJSONP(uri)
+		client := serve(t, transport)
+		packets := onEvent(transport, "packet")
+
+		res := await(t, request(client, http.MethodPost, uri, "x=4:4abc", http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}))
+		if res.status != http.StatusOK {
+			t.Fatalf("status = %d, want match for %d", res.status, http.StatusOK)
+		}
+		if len(packets) != 0 {
+			t.Fatal(`transport emitted "packet" without a "d" field`)
+		}
+	})
+
+	t.Run("non-numeric callback", func(t *testing.T) {
+		for _, tt := range []struct {
+			j    string
+			head string
+		}{
+			{"0);alert(1);//", "___eio[01]("},
+			{"abc", "___eio[]("},
+		} {
+			uri := "http://engine.io/engine.io/?EIO=3&transport=polling&j=" + url.QueryEscape(tt.j)
+			transport := newTestJSONP(uri)
+			client := serve(t, transport)
+			drain := onEvent(transport, "drain")
+
+			responses := request(client, http.MethodGet, uri, "", nil)
+			awaitEvent(t, drain, "drain")
+			transport.Send([]*packet.Packet{{Type: packet.NOOP}})
+
+			// only the digits of the callback index are kept
+			want := tt.head + `"1:6");`
+			if res := await(t, responses); res.body != want {
+				t.Fatalf("response of j=%q = %q, want match for %q", tt.j, res.body, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,454 @@
+package transports
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io-go-parser/packet"
+	_types "github.com/zishang520/engine.io-go-parser/types"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	"github.com/zishang520/engine.io/v2/errors"
+	"github.com/zishang520/engine.io/v2/events"
+	"github.com/zishang520/engine.io/v2/log"
+	e_types "github.com/zishang520/engine.io/v2/types"
+	"github.com/zishang520/engine.io/v2/utils"
+)
+
+var (
+	polling_log = log.NewLog("engine:polling")
+
+	// Content-codings supported by the http compression, in order of preference.
+	supportedEncodings = []string{"gzip", "deflate", "br"}
+)
+
+type polling struct {
+	Transport
+
+	closeTimeout time.Duration
+
+	dataCtx atomic.Pointer[types.HttpContext]
+
+	shouldClose atomic.Pointer[e_types.Callable]
+	mu          sync.Mutex
+}
+
+// HTTP polling New.
+func MakePolling() Polling {
+	p := &polling{Transport: MakeTransport()}
+
+	p.Prototype(p)
+
+	return p
+}
+
+func NewPolling(ctx *types.HttpContext) Polling {
+	p := MakePolling()
+
+	p.Construct(ctx)
+
+	return p
+}
+
+func (p *polling) Construct(ctx *types.HttpContext) {
+	p.Transport.Construct(ctx)
+
+	p.closeTimeout = 30 * 1000 * time.Millisecond
+}
+
+func (p *polling) Name() string {
+	return "polling"
+}
+
+func (p *polling) SupportsFraming() bool {
+	return false
+}
+
+// Overrides onRequest.
+func (p *polling) OnRequest(ctx *types.HttpContext) {
+	method := ctx.Method()
+
+	if fasthttp.MethodGet == method {
+		p.onPollRequest(ctx)
+	} else if fasthttp.MethodPost == method {
+		p.onDataRequest(ctx)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.Write(nil)
+	}
+}
+
+// The client sends a request awaiting for us to send data.
+func (p *polling) onPollRequest(ctx *types.HttpContext) {
+	if p.Req() != nil {
+		polling_log.Debug("request overlap")
+		// assert: p.res, '.req should be (un)set together'
+		p.OnError("overlap from client", nil)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(nil)
+		return
+	}
+
+	polling_log.Debug("setting request")
+
+	onClose := events.Listener(func(...any) {
+		p.OnError("poll connection closed prematurely", nil)
+	})
+
+	p.SetReq(ctx)
+
+	ctx.Cleanup = func() {
+		ctx.RemoveListener("close", onClose)
+		p.SetReq(nil)
+	}
+
+	ctx.On("close", onClose)
+
+	p.SetWritable(true)
+	p.Emit("drain")
+
+	// if we're still writable but had a pending close, trigger an empty send
+	if p.Writable() && p.shouldClose.Load() != nil {
+		polling_log.Debug("triggering empty send to append close packet")
+		p.Send([]*packet.Packet{
+			{
+				Type: packet.NOOP,
+			},
+		})
+	}
+}
+
+// The client sends a request with data.
+func (p *polling) onDataRequest(ctx *types.HttpContext) {
+	if p.dataCtx.Load() != nil {
+		// assert: p.dataRes, '.dataCtx should be (un)set together'
+		p.OnError("data request overlap from client", nil)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(nil)
+		return
+	}
+
+	isBinary := "application/octet-stream" == ctx.Headers().Peek("Content-Type")
+
+	if isBinary && p.Protocol() == 4 {
+		p.OnError("invalid content", nil)
+		// The fasthttp handler is waiting for a response, so the request must be ended here.
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(nil)
+		return
+	}
+
+	// DoClose may still answer the request once the handler has returned, so it is not to be recycled meanwhile
+	ctx.Retain()
+	p.dataCtx.Store(ctx)
+
+	var onClose events.Listener
+
+	cleanup := func() {
+		ctx.RemoveListener("close", onClose)
+		p.dataCtx.Store(nil)
+	}
+
+	onClose = func(...any) {
+		cleanup()
+		p.OnError("data request connection closed prematurely", nil)
+	}
+
+	ctx.On("close", onClose)
+
+	body := ctx.RequestCtx().PostBody()
+	if int64(ctx.RequestCtx().Request.Header.ContentLength()) > p.MaxHttpBufferSize() || int64(len(body)) > p.MaxHttpBufferSize() {
+		cleanup()
+		ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+		ctx.Write(nil)
+		return
+	}
+
+	var packet _types.BufferInterface
+	if isBinary {
+		packet = _types.NewBytesBuffer(nil)
+	} else {
+		packet = _types.NewStringBuffer(nil)
+	}
+	// The body belongs to the fasthttp.RequestCtx, which is recycled once the handler returns.
+	packet.Write(body)
+	p.Metrics().BytesIn(p.Name(), int64(len(body)))
+	p.Proto().OnData(packet)
+
+	headers := utils.NewParameterBag(map[string][]string{
+		// text/html is required instead of text/plain to avoid an
+		// unwanted download dialog on certain user-agents (GH-43)
+		"Content-Type":   {"text/html"},
+		"Content-Length": {"2"},
+	})
+
+	// After writing the data, close will be triggered, so it needs to be executed first.
+	cleanup()
+
+	// The following process in nodejs is asynchronous.
+	ctx.ResponseHeaders.With(responseHeaders(p, ctx, headers).All())
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	io.WriteString(ctx, "ok")
+}
+
+// Processes the incoming data payload.
+func (p *polling) OnData(data _types.BufferInterface) {
+	polling_log.Debug(`received "%s"`, data)
+
+	packets, _ := p.Parser().DecodePayload(data)
+	for _, packetData := range packets {
+		if packet.CLOSE == packetData.Type {
+			polling_log.Debug("got xhr close packet")
+			p.OnClose()
+			return
+		}
+
+		p.OnPacket(packetData)
+	}
+}
+
+// Overrides onClose.
+func (p *polling) OnClose() {
+	if p.Writable() {
+		// close pending poll request
+		p.Send([]*packet.Packet{
+			{
+				Type: packet.NOOP,
+			},
+		})
+	}
+	p.Transport.OnClose()
+}
+
+// Writes a packet payload.
+func (p *polling) Send(packets []*packet.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx := p.Req()
+
+	if ctx == nil {
+		return
+	}
+
+	p.SetWritable(false)
+	if shouldClose := p.shouldClose.Load(); shouldClose != nil {
+		polling_log.Debug("appending close packet to payload")
+		packets = append(packets, &packet.Packet{
+			Type: packet.CLOSE,
+		})
+		(*shouldClose)()
+		p.shouldClose.Store(nil)
+	}
+
+	option := &packet.Options{Compress: false}
+	for _, packetData := range packets {
+		if packetData.Options != nil && packetData.Options.Compress {
+			option.Compress = true
+			break
+		}
+	}
+
+	if p.Protocol() == 3 {
+		data, _ := p.Parser().EncodePayload(packets, p.SupportsBinary())
+		p.write(ctx, data, option)
+	} else {
+		data, _ := p.Parser().EncodePayload(packets)
+		p.write(ctx, data, option)
+	}
+}
+
+// Writes data as response to poll request.
+func (p *polling) write(ctx *types.HttpContext, data _types.BufferInterface, options *packet.Options) {
+	polling_log.Debug(`writing %#v`, data)
+	// Assert that the prototype is Polling.
+	p.Proto().(Polling).DoWrite(ctx, data, options, func(ctx *types.HttpContext) { ctx.Cleanup() })
+}
+
+// Performs the write.
+func (p *polling) DoWrite(ctx *types.HttpContext, data _types.BufferInterface, options *packet.Options, callback func(*types.HttpContext)) {
+	contentType := "application/octet-stream"
+	// explicit UTF-8 is required for pages not served under utf
+	switch data.(type) {
+	case *_types.StringBuffer:
+		contentType = "text/plain; charset=UTF-8"
+	}
+
+	headers := utils.NewParameterBag(map[string][]string{
+		"Content-Type": {contentType},
+	})
+
+	vary := false
+	respond := func(data _types.BufferInterface) {
+		headers.Set("Content-Length", strconv.Itoa(data.Len()))
+		ctx.ResponseHeaders.With(responseHeaders(p, ctx, headers).All())
+		if vary {
+			types.AppendVary(ctx.ResponseHeaders, "Accept-Encoding")
+		}
+		ctx.SetStatusCode(fasthttp.StatusOK)
+
+		// After writing the data, close will be triggered, so it needs to be executed first.
+		callback(ctx)
+
+		ctx.Write(data.Bytes())
+		p.Metrics().BytesOut(p.Name(), int64(data.Len()))
+	}
+
+	if p.HttpCompression() == nil || options == nil || !options.Compress {
+		respond(data)
+		return
+	}
+
+	if data.Len() < p.HttpCompression().Threshold {
+		respond(data)
+		return
+	}
+
+	// From here on the response depends on the "Accept-Encoding" request header.
+	vary = true
+
+	encoding := negotiateEncoding(ctx.Headers().Peek("Accept-Encoding"))
+	if encoding == "" {
+		respond(data)
+		return
+	}
+
+	buf, err := p.compress(data, encoding)
+	if err != nil {
+		polling_log.Debug(`compression error "%s"`, err.Error())
+		respond(data)
+		return
+	}
+
+	headers.Set("Content-Encoding", encoding)
+	respond(buf)
+}
+
+// Compresses data.
+func (p *polling) compress(data _types.BufferInterface, encoding string) (_types.BufferInterface, error) {
+	polling_log.Debug("compressing")
+
+	levels := p.HttpCompressionLevels()
+
+	buf := _types.NewBytesBuffer(nil)
+
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w, err = gzip.NewWriterLevel(buf, levels.GzipLevel())
+	case "deflate":
+		// the "deflate" content-coding is the zlib format (RFC 9110, section 8.4.1.2)
+		w, err = zlib.NewWriterLevel(buf, levels.DeflateLevel())
+	case "br":
+		w = brotli.NewWriterLevel(buf, levels.BrotliLevel())
+	default:
+		return nil, errors.New(fmt.Sprintf(`unsupported encoding "%s"`, encoding)).Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data.Bytes()); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Closes the transport.
+func (p *polling) DoClose(fn e_types.Callable) {
+	polling_log.Debug("closing")
+
+	if dataCtx := p.dataCtx.Load(); dataCtx != nil && !dataCtx.IsDone() {
+		polling_log.Debug("aborting ongoing data request")
+		dataCtx.ResponseHeaders.Set("Connection", "close")
+		dataCtx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		dataCtx.Write(nil)
+	}
+
+	onClose := func() {
+		if fn != nil {
+			fn()
+		}
+		p.OnClose()
+	}
+
+	if p.Writable() {
+		polling_log.Debug("transport writable - closing right away")
+		p.Send([]*packet.Packet{
+			{
+				Type: packet.CLOSE,
+			},
+		})
+		onClose()
+	} else if p.Discarded() {
+		polling_log.Debug("transport discarded - closing right away")
+		onClose()
+	} else {
+		polling_log.Debug("transport not writable - buffering orderly close")
+		closeTimeoutTimer := utils.SetTimeout(onClose, p.closeTimeout)
+		shouldClose := e_types.Callable(func() {
+			utils.ClearTimeout(closeTimeoutTimer)
+			onClose()
+		})
+		p.shouldClose.Store(&shouldClose)
+	}
+}
+
+// Selects the content-coding of a response from the "Accept-Encoding" request header,
+// honouring quality values. An empty string means the response must not be encoded.
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	wildcard := -1.0
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(param, "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					quality = q
+				} else {
+					quality = 0
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = quality
+		} else {
+			qualities[name] = quality
+		}
+	}
+
+	encoding, best := "", 0.0
+	for _, name := range supportedEncodings {
+		quality, ok := qualities[name]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > best {
+			encoding, best = name, quality
+		}
+	}
+	return encoding
+}
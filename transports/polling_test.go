@@ -0,0 +1,428 @@
+package transports
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"github.com/zishang520/engine.io-go-parser/packet"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	"github.com/zishang520/engine.io/v2/events"
+	e_types "github.com/zishang520/engine.io/v2/types"
+)
+
+// A response read by the client of a test server.
+type response struct {
+	status int
+	header http.Header
+	body   string
+	err    error
+}
+
+// Returns a context of a request to the given URI, to construct the transports from.
+func newContext(uri string) *types.HttpContext {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(uri)
+	return types.NewHttpContext(ctx)
+}
+
+// Serves the requests with the given transport, after the given middlewares, returning a client of the in-memory
+// server.
+func serve(t *testing.T, transport Transport, middlewares ...func(*types.HttpContext, func(error))) *http.Client {
+	t.Helper()
+
+	ln := fasthttputil.NewInmemoryListener()
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			c := types.NewHttpContext(ctx)
+			for _, middleware := range middlewares {
+				middleware(c, func(error) {})
+			}
+			transport.OnRequest(c)
+			<-c.Done()
+		},
+	}
+	go server.Serve(ln)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return ln.Dial()
+			},
+			// the responses are compared as written
+			DisableCompression: true,
+		},
+	}
+	t.Cleanup(func() {
+		client.CloseIdleConnections()
+		// answers the pending polls
+		transport.Discard()
+		transport.Close()
+		server.Shutdown()
+	})
+
+	return client
+}
+
+// Sends a request, the response being read in the background.
+func request(client *http.Client, method, url, body string, header http.Header) <-chan *response {
+	responses := make(chan *response, 1)
+	go func() {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			responses <- &response{err: err}
+			return
+		}
+		for k, values := range header {
+			req.Header[k] = values
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			responses <- &response{err: err}
+			return
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		responses <- &response{status: res.StatusCode, header: res.Header, body: string(data), err: err}
+	}()
+	return responses
+}
+
+// Waits for the response of a request.
+func await(t *testing.T, responses <-chan *response) *response {
+	t.Helper()
+
+	select {
+	case res := <-responses:
+		if res.err != nil {
+			t.Fatalf("request error = %v", res.err)
+		}
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+	}
+	return nil
+}
+
+// Waits for an event of the transport.
+func awaitEvent(t *testing.T, args <-chan []any, name events.EventName) []any {
+	t.Helper()
+
+	select {
+	case a := <-args:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatalf(`transport did not emit %q`, name)
+	}
+	return nil
+}
+
+// Returns a channel receiving the arguments of the given event of the transport.
+func onEvent(transport Transport, name events.EventName) <-chan []any {
+	args := make(chan []any, 16)
+	transport.On(name, func(a ...any) {
+		args <- a
+	})
+	return args
+}
+
+func newTestPolling(uri string) Polling {
+	transport := NewPolling(newContext(uri))
+	transport.SetMaxHttpBufferSize(1e6)
+	return transport
+}
+
+func TestPolling(t *testing.T) {
+	const url = "http://engine.io/engine.io/?EIO=4&transport=polling"
+
+	t.Run("post", func(t *testing.T) {
+		transport := newTestPolling(url)
+		client := serve(t, transport)
+		packets := onEvent(transport, "packet")
+
+		res := await(t, request(client, http.MethodPost, url, "4hello\x1e4world", http.Header{"Content-Type": {"text/plain;charset=UTF-8"}}))
+		if res.status != http.StatusOK || res.body != "ok" || res.header.Get("Content-Type") != "text/html" {
+			t.Fatalf("response = %d, %q, %v, want match for %d, %q", res.status, res.body, res.header, http.StatusOK, "ok")
+		}
+		for _, want := range []string{"hello", "world"} {
+			p := awaitEvent(t, packets, "packet")[0].(*packet.Packet)
+			if data, _ := io.ReadAll(p.Data); p.Type != packet.MESSAGE || string(data) != want {
+				t.Fatalf("packet = %s %q, want match for a message %q", p.Type, data, want)
+			}
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		transport := newTestPolling(url)
+		client := serve(t, transport)
+		drain := onEvent(transport, "drain")
+
+		responses := request(client, http.MethodGet, url, "", nil)
+		awaitEvent(t, drain, "drain")
+		transport.Send([]*packet.Packet{
+			{Type: packet.MESSAGE, Data: strings.NewReader("hello")},
+			{Type: packet.MESSAGE, Data: strings.NewReader("world")},
+		})
+
+		res := await(t, responses)
+		if res.status != http.StatusOK || res.body != "4hello\x1e4world" {
+			t.Fatalf("response = %d, %q, want match for %d, %q", res.status, res.body, http.StatusOK, "4hello\x1e4world")
+		}
+		if contentType := res.header.Get("Content-Type"); contentType != "text/plain; charset=UTF-8" {
+			t.Fatalf("Content-Type = %q, want match for %q", contentType, "text/plain; charset=UTF-8")
+		}
+	})
+
+	t.Run("payload too large", func(t *testing.T) {
+		transport := newTestPolling(url)
+		transport.SetMaxHttpBufferSize(10)
+		client := serve(t, transport)
+		packets := onEvent(transport, "packet")
+
+		res := await(t, request(client, http.MethodPost, url, "4"+strings.Repeat("a", 10), nil))
+		if res.status != http.StatusRequestEntityTooLarge {
+			t.Fatalf("status = %d, want match for %d", res.status, http.StatusRequestEntityTooLarge)
+		}
+		if len(packets) != 0 {
+			t.Fatal(`transport emitted "packet" for a payload too large`)
+		}
+
+		// the transport is still usable
+		res = await(t, request(client, http.MethodPost, url, "4"+strings.Repeat("a", 9), nil))
+		if res.status != http.StatusOK {
+			t.Fatalf("status = %d, want match for %d", res.status, http.StatusOK)
+		}
+	})
+
+	t.Run("overlapping polls", func(t *testing.T) {
+		transport := newTestPolling(url)
+		client := serve(t, transport)
+		drain, errs := onEvent(transport, "drain"), onEvent(transport, "error")
+
+		responses := request(client, http.MethodGet, url, "", nil)
+		awaitEvent(t, drain, "drain")
+
+		res := await(t, request(client, http.MethodGet, url, "", nil))
+		if res.status != http.StatusBadRequest {
+			t.Fatalf("status = %d, want match for %d", res.status, http.StatusBadRequest)
+		}
+		if err := awaitEvent(t, errs, "error")[0].(error); !strings.Contains(err.Error(), "overlap from client") {
+			t.Fatalf(`error = %v, want match for "overlap from client"`, err)
+		}
+
+		// the pending poll is kept
+		transport.Send([]*packet.Packet{{Type: packet.MESSAGE, Data: strings.NewReader("hello")}})
+		if res := await(t, responses); res.status != http.StatusOK || res.body != "4hello" {
+			t.Fatalf("response = %d, %q, want match for %d, %q", res.status, res.body, http.StatusOK, "4hello")
+		}
+	})
+
+	t.Run("close with a pending poll", func(t *testing.T) {
+		transport := newTestPolling(url)
+		client := serve(t, transport)
+		drain, closes := onEvent(transport, "drain"), onEvent(transport, "close")
+
+		responses := request(client, http.MethodGet, url, "", nil)
+		awaitEvent(t, drain, "drain")
+
+		closed := make(chan struct{})
+		transport.Close(func() { close(closed) })
+
+		// the close packet answers the pending poll
+		if res := await(t, responses); res.status != http.StatusOK || res.body != "1" {
+			t.Fatalf("response = %d, %q, want match for %d, %q", res.status, res.body, http.StatusOK, "1")
+		}
+		awaitEvent(t, closes, "close")
+		select {
+		case <-closed:
+		default:
+			t.Fatal("Close() callback was not called")
+		}
+	})
+
+	t.Run("close without a pending poll", func(t *testing.T) {
+		transport := newTestPolling(url)
+		client := serve(t, transport)
+		closes := onEvent(transport, "close")
+
+		transport.Close()
+		if len(closes) != 0 {
+			t.Fatal(`transport emitted "close" before the close packet was sent`)
+		}
+
+		// the close packet is sent with the next poll
+		if res := await(t, request(client, http.MethodGet, url, "", nil)); res.status != http.StatusOK || res.body != "6\x1e1" {
+			t.Fatalf("response = %d, %q, want match for %d, %q", res.status, res.body, http.StatusOK, "6\x1e1")
+		}
+		awaitEvent(t, closes, "close")
+	})
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate, br", "deflate"},
+		{"gzip;q=0.5, br;q=1", "br"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=abc", ""},
+		{"identity", ""},
+		{"identity;q=0", ""},
+		{"identity;q=0, br", "br"},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"*, gzip;q=0", "deflate"},
+		{"br;q=0.1, *;q=0.5", "gzip"},
+	} {
+		if encoding := negotiateEncoding(tt.acceptEncoding); encoding != tt.want {
+			t.Fatalf(`negotiateEncoding(%q) = %q, want match for %q`, tt.acceptEncoding, encoding, tt.want)
+		}
+	}
+}
+
+func TestPollingCompression(t *testing.T) {
+	const url = "http://engine.io/engine.io/?EIO=4&transport=polling"
+
+	// Answers a poll with a message of the given data, to be compressed.
+	poll := func(t *testing.T, transport Polling, client *http.Client, data string, header http.Header) *response {
+		t.Helper()
+
+		drain := onEvent(transport, "drain")
+		responses := request(client, http.MethodGet, url, "", header)
+		awaitEvent(t, drain, "drain")
+		transport.Send([]*packet.Packet{
+			{Type: packet.MESSAGE, Data: strings.NewReader(data), Options: &packet.Options{Compress: true}},
+		})
+		return await(t, responses)
+	}
+
+	t.Run("threshold", func(t *testing.T) {
+		transport := newTestPolling(url)
+		transport.SetHttpCompression(&e_types.HttpCompression{Threshold: 10})
+		client := serve(t, transport)
+		header := http.Header{"Accept-Encoding": {"gzip"}}
+
+		// the payloads of 9 and 10 bytes
+		if res := poll(t, transport, client, strings.Repeat("a", 8), header); res.header.Get("Content-Encoding") != "" || res.header.Get("Vary") != "" {
+			t.Fatalf("headers = %v, want match for an uncompressed response without Vary", res.header)
+		}
+		res := poll(t, transport, client, strings.Repeat("a", 9), header)
+		if res.header.Get("Content-Encoding") != "gzip" || res.header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("headers = %v, want match for a gzip response varying with Accept-Encoding", res.header)
+		}
+		if body := decode(t, "gzip", res.body); body != "4"+strings.Repeat("a", 9) {
+			t.Fatalf("body = %q, want match for %q", body, "4"+strings.Repeat("a", 9))
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		transport := newTestPolling(url)
+		transport.SetHttpCompression(&e_types.HttpCompression{Threshold: 0})
+		client := serve(t, transport)
+
+		// the response still varies with the header
+		res := poll(t, transport, client, "hello", http.Header{"Accept-Encoding": {"identity;q=0"}})
+		if res.body != "4hello" || res.header.Get("Content-Encoding") != "" || res.header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("response = %q, %v, want match for an uncompressed response varying with Accept-Encoding", res.body, res.header)
+		}
+	})
+
+	t.Run("cors vary", func(t *testing.T) {
+		transport := newTestPolling(url)
+		transport.SetHttpCompression(&e_types.HttpCompression{Threshold: 0})
+		client := serve(t, transport, types.MiddlewareWrapper(&types.Cors{Origin: []any{"http://example.com"}}))
+
+		res := poll(t, transport, client, "hello", http.Header{"Accept-Encoding": {"br"}, "Origin": {"http://example.com"}})
+		if vary := res.header.Values("Vary"); len(vary) != 1 || vary[0] != "Origin, Accept-Encoding" {
+			t.Fatalf("Vary = %q, want match for %q", vary, "Origin, Accept-Encoding")
+		}
+		if origin := res.header.Get("Access-Control-Allow-Origin"); origin != "http://example.com" {
+			t.Fatalf("Access-Control-Allow-Origin = %q, want match for %q", origin, "http://example.com")
+		}
+	})
+
+	t.Run("upstream vary", func(t *testing.T) {
+		transport := newTestPolling(url)
+		transport.SetHttpCompression(&e_types.HttpCompression{Threshold: 0})
+		client := serve(t, transport, func(ctx *types.HttpContext, next func(error)) {
+			// e.g. a middleware of the router
+			ctx.RequestCtx().Response.Header.Set("Vary", "Cookie, accept-encoding")
+			next(nil)
+		})
+
+		res := poll(t, transport, client, "hello", http.Header{"Accept-Encoding": {"gzip"}})
+		if vary := res.header.Values("Vary"); len(vary) != 1 || vary[0] != "Cookie, accept-encoding" {
+			t.Fatalf("Vary = %q, want match for %q", vary, "Cookie, accept-encoding")
+		}
+
+		res = await(t, request(client, http.MethodPost, url, "4hello", nil))
+		if vary := res.header.Get("Vary"); vary != "Cookie, accept-encoding" {
+			t.Fatalf("Vary = %q, want match for %q", vary, "Cookie, accept-encoding")
+		}
+	})
+
+	t.Run("codecs", func(t *testing.T) {
+		data := strings.Repeat("engine.io ", 200)
+		for _, levels := range []*types.HttpCompressionLevels{
+			nil,
+			{Gzip: types.CompressionLevel(0), Deflate: types.CompressionLevel(0), Brotli: types.CompressionLevel(0)},
+			{Gzip: types.CompressionLevel(-2), Deflate: types.CompressionLevel(9), Brotli: types.CompressionLevel(11)},
+		} {
+			for _, encoding := range []string{"gzip", "deflate", "br"} {
+				transport := newTestPolling(url)
+				transport.SetHttpCompression(&e_types.HttpCompression{Threshold: 0})
+				transport.SetHttpCompressionLevels(levels)
+				client := serve(t, transport)
+
+				res := poll(t, transport, client, data, http.Header{"Accept-Encoding": {encoding}})
+				if contentEncoding := res.header.Get("Content-Encoding"); contentEncoding != encoding {
+					t.Fatalf("Content-Encoding = %q, want match for %q", contentEncoding, encoding)
+				}
+				if contentLength := res.header.Get("Content-Length"); contentLength != strconv.Itoa(len(res.body)) {
+					t.Fatalf("Content-Length = %s, want match for %d", contentLength, len(res.body))
+				}
+				if body := decode(t, encoding, res.body); body != "4"+data {
+					t.Fatalf("%s body with the levels %+v = %q, want match for the payload", encoding, levels, body)
+				}
+			}
+		}
+	})
+}
+
+// Decodes a body of the given content-coding.
+func decode(t *testing.T, encoding, body string) string {
+	t.Helper()
+
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(strings.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(strings.NewReader(body))
+	case "br":
+		r = brotli.NewReader(strings.NewReader(body))
+	}
+	if err != nil {
+		t.Fatalf("%s reader error = %v", encoding, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s read error = %v", encoding, err)
+	}
+	return string(data)
+}
@@ -0,0 +1,47 @@
+package transports
+
+import (
+	ws "github.com/fasthttp/websocket"
+	_types "github.com/zishang520/engine.io-go-parser/types"
+)
+
+// A pre-encoded packet shared by the packets of several sockets through [packet.Options.WsPreEncodedFrame],
+// the websocket transports send it as a websocket.PreparedMessage, which frames the message once per
+// compression setting.
+type PreparedFrame struct {
+	_types.BufferInterface
+
+	message *ws.PreparedMessage
+}
+
+// Wraps a packet encoded by the parser of the sockets, the frame must not be read afterwards.
+func NewPreparedFrame(data _types.BufferInterface) (*PreparedFrame, error) {
+	mt := ws.BinaryMessage
+	if isTextFrame(data) {
+		mt = ws.TextMessage
+	}
+	message, err := ws.NewPreparedMessage(mt, data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedFrame{BufferInterface: data, message: message}, nil
+}
+
+// Returns the websocket.PreparedMessage of the frame.
+func (f *PreparedFrame) PreparedMessage() *ws.PreparedMessage {
+	return f.message
+}
+
+// Returns the encoded packet.
+func (f *PreparedFrame) Frame() _types.BufferInterface {
+	return f.BufferInterface
+}
+
+// Reports whether an encoded packet is sent as a text message.
+func isTextFrame(data _types.BufferInterface) bool {
+	if f, ok := data.(*PreparedFrame); ok {
+		data = f.Frame()
+	}
+	_, ok := data.(*_types.StringBuffer)
+	return ok
+}
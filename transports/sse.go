@@ -0,0 +1,363 @@
+package transports
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io-go-parser/packet"
+	_types "github.com/zishang520/engine.io-go-parser/types"
+	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	"github.com/zishang520/engine.io/v2/events"
+	"github.com/zishang520/engine.io/v2/log"
+	e_types "github.com/zishang520/engine.io/v2/types"
+	"github.com/zishang520/engine.io/v2/utils"
+)
+
+var sse_log = log.NewLog("engine:sse")
+
+type sse struct {
+	Transport
+
+	dataCtx atomic.Pointer[types.HttpContext]
+
+	streaming atomic.Bool
+	queue     [][]byte
+	notify    chan e_types.Void
+	done      chan e_types.Void
+	stopOnce  sync.Once
+
+	mu sync.Mutex
+}
+
+// Server-Sent Events transport.
+//
+// The packets are pushed to the client as the events of a single held "text/event-stream" response,
+// the data of each event being the JSON string of one encoded packet. The client sends its packets
+// with POST requests, encoded as a polling payload.
+func MakeSSE() SSE {
+	s := &sse{Transport: MakeTransport()}
+
+	s.Prototype(s)
+
+	return s
+}
+
+func NewSSE(ctx *types.HttpContext) SSE {
+	s := MakeSSE()
+
+	s.Construct(ctx)
+
+	return s
+}
+
+func (s *sse) Construct(ctx *types.HttpContext) {
+	s.Transport.Construct(ctx)
+
+	s.notify = make(chan e_types.Void, 1)
+	s.done = make(chan e_types.Void)
+}
+
+// Transport name
+func (s *sse) Name() string {
+	return "sse"
+}
+
+// Advertise framing support.
+func (s *sse) SupportsFraming() bool {
+	return true
+}
+
+// Overrides onRequest.
+func (s *sse) OnRequest(ctx *types.HttpContext) {
+	method := ctx.Method()
+
+	if fasthttp.MethodGet == method {
+		s.onStreamRequest(ctx)
+	} else if fasthttp.MethodPost == method {
+		s.onDataRequest(ctx)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.Write(nil)
+	}
+}
+
+// The client opens the event stream, there is only one per session.
+func (s *sse) onStreamRequest(ctx *types.HttpContext) {
+	if !s.streaming.CompareAndSwap(false, true) {
+		sse_log.Debug("stream overlap")
+		s.OnError("overlap from client", nil)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(nil)
+		return
+	}
+
+	sse_log.Debug("setting stream")
+
+	// referenced while streaming
+	ctx.Retain()
+	s.SetReq(ctx)
+
+	headers := utils.NewParameterBag(map[string][]string{
+		"Content-Type": {"text/event-stream; charset=UTF-8"},
+		// disables the response buffering of reverse proxies such as nginx
+		"X-Accel-Buffering": {"no"},
+	})
+
+	ctx.ResponseHeaders.With(responseHeaders(s, ctx, headers).All())
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	if err := ctx.SetBodyStreamWriter(s.stream); err != nil {
+		s.streaming.Store(false)
+		s.OnError("stream request error", err)
+		return
+	}
+
+	s.SetWritable(true)
+	s.Emit("drain")
+}
+
+// Writes the queued events to the response stream until the transport is closed.
+func (s *sse) stream(w *bufio.Writer) {
+	defer func() {
+		s.SetWritable(false)
+		s.streaming.Store(false)
+	}()
+
+	// a comment line, so that the client knows right away that the stream is open
+	if _, err := w.WriteString(":\n\n"); err != nil {
+		s.onStreamError(err)
+		return
+	}
+	if err := w.Flush(); err != nil {
+		s.onStreamError(err)
+		return
+	}
+
+	for {
+		select {
+		case <-s.notify:
+			if err := s.flush(w); err != nil {
+				s.onStreamError(err)
+				return
+			}
+		case <-s.done:
+			// the close packet may still be queued
+			if err := s.flush(w); err != nil {
+				sse_log.Debug(`flush error "%s"`, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// Writes the queued events, "drain" being emitted once they all reached the socket.
+func (s *sse) flush(w *bufio.Writer) error {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	if len(queue) == 0 {
+		return nil
+	}
+
+	for _, event := range queue {
+		n, err := w.Write(event)
+		s.Metrics().BytesOut(s.Name(), int64(n))
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	// the events queued while writing are written by the next flush
+	drained := len(s.queue) == 0 && !s.stopped()
+	if drained {
+		s.SetWritable(true)
+	}
+	s.mu.Unlock()
+
+	if drained {
+		s.Emit("drain")
+	}
+	return nil
+}
+
+func (s *sse) onStreamError(err error) {
+	select {
+	case <-s.done:
+	default:
+		s.OnError("stream connection closed prematurely", err)
+	}
+}
+
+// Ends the response stream.
+func (s *sse) stop() {
+	s.stopOnce.Do(func() {
+		s.SetWritable(false)
+		close(s.done)
+	})
+}
+
+func (s *sse) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// The client sends a request with data.
+func (s *sse) onDataRequest(ctx *types.HttpContext) {
+	if s.dataCtx.Load() != nil {
+		// assert: s.dataRes, '.dataCtx should be (un)set together'
+		s.OnError("data request overlap from client", nil)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(nil)
+		return
+	}
+
+	// the events carry text only, so does the client
+	if "application/octet-stream" == ctx.Headers().Peek("Content-Type") {
+		s.OnError("invalid content", nil)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(nil)
+		return
+	}
+
+	// DoClose may still answer the request once the handler has returned, so it is not to be recycled meanwhile
+	ctx.Retain()
+	s.dataCtx.Store(ctx)
+
+	var onClose events.Listener
+
+	cleanup := func() {
+		ctx.RemoveListener("close", onClose)
+		s.dataCtx.Store(nil)
+	}
+
+	onClose = func(...any) {
+		cleanup()
+		s.OnError("data request connection closed prematurely", nil)
+	}
+
+	ctx.On("close", onClose)
+
+	body := ctx.RequestCtx().PostBody()
+	if int64(ctx.RequestCtx().Request.Header.ContentLength()) > s.MaxHttpBufferSize() || int64(len(body)) > s.MaxHttpBufferSize() {
+		cleanup()
+		ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+		ctx.Write(nil)
+		return
+	}
+
+	// The body belongs to the fasthttp.RequestCtx, which is recycled once the handler returns.
+	packet := _types.NewStringBuffer(nil)
+	packet.Write(body)
+	s.Metrics().BytesIn(s.Name(), int64(len(body)))
+	s.Proto().OnData(packet)
+
+	headers := utils.NewParameterBag(map[string][]string{
+		"Content-Type":   {"text/html"},
+		"Content-Length": {"2"},
+	})
+
+	// After writing the data, close will be triggered, so it needs to be executed first.
+	cleanup()
+
+	ctx.ResponseHeaders.With(responseHeaders(s, ctx, headers).All())
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	io.WriteString(ctx, "ok")
+}
+
+// Processes the incoming data payload.
+func (s *sse) OnData(data _types.BufferInterface) {
+	sse_log.Debug(`received "%s"`, data)
+
+	packets, _ := s.Parser().DecodePayload(data)
+	for _, packetData := range packets {
+		if packet.CLOSE == packetData.Type {
+			sse_log.Debug("got sse close packet")
+			s.OnClose()
+			return
+		}
+
+		s.OnPacket(packetData)
+	}
+}
+
+// Overrides onClose.
+func (s *sse) OnClose() {
+	s.stop()
+	s.Transport.OnClose()
+}
+
+// Writes a packet payload.
+func (s *sse) Send(packets []*packet.Packet) {
+	if s.stopped() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// writable again once the stream has written the queue
+	s.SetWritable(false)
+
+	for _, packet := range packets {
+		// binary data is base64 encoded, the events carry text only
+		data, err := s.Parser().EncodePacket(packet, false)
+		if err != nil {
+			sse_log.Debug(`Send Error "%s"`, err.Error())
+			s.OnError("encode error", err)
+			return
+		}
+		event, err := json.Marshal(data.String())
+		if err != nil {
+			sse_log.Debug(`Send Error "%s"`, err.Error())
+			s.OnError("encode error", err)
+			return
+		}
+		sse_log.Debug(`writing %s`, event)
+		s.queue = append(s.queue, []byte("data: "+string(event)+"\n\n"))
+	}
+
+	select {
+	case s.notify <- e_types.NULL:
+	default:
+	}
+}
+
+// Closes the transport.
+func (s *sse) DoClose(fn e_types.Callable) {
+	sse_log.Debug("closing")
+
+	if dataCtx := s.dataCtx.Load(); dataCtx != nil && !dataCtx.IsDone() {
+		sse_log.Debug("aborting ongoing data request")
+		dataCtx.ResponseHeaders.Set("Connection", "close")
+		dataCtx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		dataCtx.Write(nil)
+	}
+
+	// once upgraded, the client no longer listens to the stream
+	if !s.Discarded() && s.streaming.Load() {
+		s.Send([]*packet.Packet{
+			{
+				Type: packet.CLOSE,
+			},
+		})
+	}
+	s.stop()
+
+	if fn != nil {
+		fn()
+	}
+	s.OnClose()
+}
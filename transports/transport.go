@@ -1,7 +1,9 @@
 package transports
 
 import (
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/zishang520/engine.io-go-parser/packet"
 	"github.com/zishang520/engine.io-go-parser/parser"
@@ -11,6 +13,7 @@ import (
 	"github.com/zishang520/engine.io/v2/events"
 	"github.com/zishang520/engine.io/v2/log"
 	e_types "github.com/zishang520/engine.io/v2/types"
+	"github.com/zishang520/engine.io/v2/utils"
 )
 
 var transport_log = log.NewLog("engine:transport")
@@ -23,7 +26,12 @@ type transport struct {
 
 	maxHttpBufferSize int64
 	httpCompression   *e_types.HttpCompression
+	compressionLevels *types.HttpCompressionLevels
 	perMessageDeflate *e_types.PerMessageDeflate
+	metrics           atomic.Pointer[types.Metrics]
+	readTimeout       atomic.Int64
+	writeTimeout      atomic.Int64
+	maxStall          atomic.Int64
 
 	sid      string
 	protocol int // 3
@@ -133,6 +141,15 @@ func (t *transport) SetHttpCompression(httpCompression *e_types.HttpCompression)
 	t.httpCompression = httpCompression
 
 }
+
+func (t *transport) HttpCompressionLevels() *types.HttpCompressionLevels {
+	return t.compressionLevels
+}
+
+func (t *transport) SetHttpCompressionLevels(compressionLevels *types.HttpCompressionLevels) {
+	t.compressionLevels = compressionLevels
+}
+
 func (t *transport) PerMessageDeflate() *e_types.PerMessageDeflate {
 	return t.perMessageDeflate
 }
@@ -149,6 +166,38 @@ func (t *transport) SetMaxHttpBufferSize(maxHttpBufferSize int64) {
 	t.maxHttpBufferSize = maxHttpBufferSize
 }
 
+func (t *transport) Metrics() *types.Metrics {
+	return t.metrics.Load()
+}
+
+func (t *transport) SetMetrics(metrics *types.Metrics) {
+	t.metrics.Store(metrics)
+}
+
+func (t *transport) ReadTimeout() time.Duration {
+	return time.Duration(t.readTimeout.Load())
+}
+
+func (t *transport) SetReadTimeout(readTimeout time.Duration) {
+	t.readTimeout.Store(int64(readTimeout))
+}
+
+func (t *transport) WriteTimeout() time.Duration {
+	return time.Duration(t.writeTimeout.Load())
+}
+
+func (t *transport) SetWriteTimeout(writeTimeout time.Duration) {
+	t.writeTimeout.Store(int64(writeTimeout))
+}
+
+func (t *transport) MaxStall() time.Duration {
+	return time.Duration(t.maxStall.Load())
+}
+
+func (t *transport) SetMaxStall(maxStall time.Duration) {
+	t.maxStall.Store(int64(maxStall))
+}
+
 // Transport Construct.
 func (t *transport) Construct(ctx *types.HttpContext) {
 	if eio, ok := ctx.Query().Get("EIO"); ok && eio == "4" {
@@ -230,3 +279,16 @@ func (t *transport) Send([]*packet.Packet) {
 func (t *transport) DoClose(e_types.Callable) {
 	transport_log.Debug("Not implemented")
 }
+
+// Returns the headers of a response of the HTTP transports, which are emitted with "headers" so that they can be
+// modified, e.g. to set a cookie.
+func responseHeaders(t Transport, ctx *types.HttpContext, headers *utils.ParameterBag) *utils.ParameterBag {
+	// prevent XSS warnings on IE
+	// https://github.com/socketio/socket.io/pull/1333
+	if ua := ctx.UserAgent(); (len(ua) > 0) && ((strings.Index(ua, ";MSIE") > -1) || (strings.Index(ua, "Trident/") > -1)) {
+		headers.Set("X-XSS-Protection", "0")
+	}
+	headers.Set("Cache-Control", "no-store")
+	t.Emit("headers", headers, ctx)
+	return headers
+}
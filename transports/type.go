@@ -1,6 +1,8 @@
 package transports
 
 import (
+	"time"
+
 	"github.com/zishang520/engine.io-go-parser/packet"
 	"github.com/zishang520/engine.io-go-parser/parser"
 	_types "github.com/zishang520/engine.io-go-parser/types"
@@ -28,8 +30,13 @@ type (
 		SetSupportsBinary(bool)
 		SetReadyState(string)
 		SetHttpCompression(*e_types.HttpCompression)
+		SetHttpCompressionLevels(*types.HttpCompressionLevels)
 		SetPerMessageDeflate(*e_types.PerMessageDeflate)
 		SetMaxHttpBufferSize(int64)
+		SetMetrics(*types.Metrics)
+		SetReadTimeout(time.Duration)
+		SetWriteTimeout(time.Duration)
+		SetMaxStall(time.Duration)
 
 		// #getters
 
@@ -46,8 +53,17 @@ type (
 		SupportsBinary() bool
 		ReadyState() string
 		HttpCompression() *e_types.HttpCompression
+		HttpCompressionLevels() *types.HttpCompressionLevels
 		PerMessageDeflate() *e_types.PerMessageDeflate
 		MaxHttpBufferSize() int64
+		// The collector the traffic is recorded to, if any.
+		Metrics() *types.Metrics
+		// How long the connection may stay silent before it is considered dead, no deadline if zero.
+		ReadTimeout() time.Duration
+		// How long writing a message may take, no deadline if zero.
+		WriteTimeout() time.Duration
+		// How long the queued packets may wait to be written before the client is considered too slow, no limit if zero.
+		MaxStall() time.Duration
 		// @abstract
 		HandlesUpgrades() bool
 		// @abstract
@@ -111,4 +127,16 @@ type (
 
 		Transport
 	}
+
+	WebTransport interface {
+		// #extends
+
+		Transport
+	}
+
+	SSE interface {
+		// #extends
+
+		Transport
+	}
 )
@@ -1,24 +1,54 @@
 package transports
 
 import (
+	"encoding/binary"
 	"io"
+	"os"
 	"sync"
+	"time"
 
 	ws "github.com/fasthttp/websocket"
 	"github.com/zishang520/engine.io-go-parser/packet"
 	_types "github.com/zishang520/engine.io-go-parser/types"
 	"github.com/zishang520/engine.io-server-go-fasthttp/v2/types"
+	"github.com/zishang520/engine.io/v2/errors"
 	"github.com/zishang520/engine.io/v2/log"
 	e_types "github.com/zishang520/engine.io/v2/types"
 )
 
-var ws_log = log.NewLog("engine:ws")
+var (
+	ws_log = log.NewLog("engine:ws")
+
+	// A message could not be written in time, the client being too slow or gone.
+	ErrWriteTimeout = errors.New("write timeout").Err()
+)
+
+// The size from which the coalesced frames are written without waiting for the next packets of the pass.
+const maxBatchSize = 64 * 1024
 
 type websocket struct {
 	Transport
 
 	socket *types.WebSocketConn
-	mu     sync.Mutex
+
+	// the packets to be written by the writer loop, the ones of the Send calls made while it writes being taken
+	// together by its next pass.
+	queue  []*packet.Packet
+	notify chan e_types.Void
+	// when the first packet of the queue was queued.
+	queuedAt time.Time
+	// set by DoClose, the connection being closed once the queue is written.
+	closing bool
+	onClose e_types.Callable
+	// whether the writer loop is writing a pass, or has returned.
+	writing bool
+	stopped bool
+	mu      sync.Mutex
+
+	// the frames of the uncompressed packets of a pass, written to the connection at once.
+	batch []byte
+	// held by the writes made out of the websocket connection, and by its control frames.
+	writeMu sync.Mutex
 }
 
 // WebSocket transport
@@ -42,8 +72,24 @@ func (w *websocket) Construct(ctx *types.HttpContext) {
 	w.Transport.Construct(ctx)
 
 	w.socket = ctx.Websocket
+	w.notify = make(chan e_types.Void, 1)
+
+	// the coalesced frames are written out of the websocket connection, its control frames are not to be written
+	// in between
+	ping, closing := w.socket.PingHandler(), w.socket.CloseHandler()
+	w.socket.SetPingHandler(func(data string) error {
+		w.writeMu.Lock()
+		defer w.writeMu.Unlock()
+		return ping(data)
+	})
+	w.socket.SetCloseHandler(func(code int, text string) error {
+		w.writeMu.Lock()
+		defer w.writeMu.Unlock()
+		return closing(code, text)
+	})
 
 	go w._init()
+	go w.writeLoop()
 
 	w.socket.On("error", func(errors ...any) {
 		w.OnError("websocket error", errors[0].(error))
@@ -76,6 +122,10 @@ func (w *websocket) _init() {
 		case <-w.socket.Done():
 			return
 		default:
+			// a backstop to the heartbeat, should a half-open connection never deliver the close
+			if timeout := w.ReadTimeout(); timeout > 0 {
+				w.socket.SetReadDeadline(time.Now().Add(timeout))
+			}
 			mt, message, err := w.socket.NextReader()
 			if err != nil {
 				if ws.IsUnexpectedCloseError(err) {
@@ -89,16 +139,18 @@ func (w *websocket) _init() {
 			switch mt {
 			case ws.BinaryMessage:
 				read := _types.NewBytesBuffer(nil)
-				if _, err := read.ReadFrom(message); err != nil {
+				if n, err := read.ReadFrom(message); err != nil {
 					w.socket.Emit("error", err)
 				} else {
+					w.Metrics().BytesIn(w.Name(), n)
 					w.onMessage(read)
 				}
 			case ws.TextMessage:
 				read := _types.NewStringBuffer(nil)
-				if _, err := read.ReadFrom(message); err != nil {
+				if n, err := read.ReadFrom(message); err != nil {
 					w.socket.Emit("error", err)
 				} else {
+					w.Metrics().BytesIn(w.Name(), n)
 					w.onMessage(read)
 				}
 			case ws.CloseMessage:
@@ -122,59 +174,213 @@ func (w *websocket) onMessage(data _types.BufferInterface) {
 	w.Transport.OnData(data)
 }
 
-// Writes a packet payload.
+// Queues a packet payload, which is written by the writer loop so that the caller never blocks on the network.
+//
+// Each packet stays a websocket message of its own, as the protocol requires, but the frames of the uncompressed
+// packets queued together are coalesced into a write to the connection of up to 64KB.
 func (w *websocket) Send(packets []*packet.Packet) {
+	w.mu.Lock()
 	w.SetWritable(false)
+	if len(w.queue) == 0 {
+		w.queuedAt = time.Now()
+	}
+	w.queue = append(w.queue, packets...)
+	w.mu.Unlock()
+
+	w.wake()
+}
+
+// Wakes the writer loop up.
+func (w *websocket) wake() {
+	select {
+	case w.notify <- e_types.Void{}:
+	default:
+	}
+}
+
+// Writes the queued packets until the connection is closed, "drain" being emitted whenever the queue is empty.
+func (w *websocket) writeLoop() {
 	defer func() {
-		w.SetWritable(true)
-		w.Emit("drain")
-	}()
+		w.mu.Lock()
+		w.writing = false
+		w.stopped = true
+		closing, onClose := w.closing, w.onClose
+		w.closing, w.onClose = false, nil
+		w.mu.Unlock()
 
-	w.mu.Lock()
-	defer w.mu.Unlock()
+		if closing {
+			w.close(onClose)
+		}
+	}()
 
-	for _, packet := range packets {
-		// always creates a new object since ws modifies it
-		compress := false
-		if packet.Options != nil {
-			compress = packet.Options.Compress
+	for {
+		select {
+		case <-w.socket.Done():
+			return
+		case <-w.notify:
+		}
 
-			if packet.Options.WsPreEncoded != nil {
-				w.write(packet.Options.WsPreEncoded, compress)
-				return
+		// the packets queued while writing are written by the same pass, one message each
+		for {
+			w.mu.Lock()
+			packets, queuedAt := w.queue, w.queuedAt
+			w.queue = nil
+			w.writing = len(packets) > 0
+			w.mu.Unlock()
 
-			} else if w.PerMessageDeflate() == nil && packet.Options.WsPreEncodedFrame != nil {
-				mt := ws.BinaryMessage
-				if _, ok := packet.Options.WsPreEncodedFrame.(*_types.StringBuffer); ok {
-					mt = ws.TextMessage
-				}
-				pm, err := ws.NewPreparedMessage(mt, packet.Options.WsPreEncodedFrame.Bytes())
-				if err != nil {
-					ws_log.Debug(`Send Error "%s"`, err.Error())
-					w.socket.Emit("error", err)
-					return
-				}
-				if err := w.socket.WritePreparedMessage(pm); err != nil {
-					ws_log.Debug(`Send Error "%s"`, err.Error())
+			if len(packets) == 0 {
+				break
+			}
+			if err := w.writePackets(packets, w.writeDeadline(queuedAt)); err != nil {
+				ws_log.Debug(`Send Error "%s"`, err.Error())
+				if os.IsTimeout(err) {
+					w.OnError("write timeout", ErrWriteTimeout)
+				} else {
 					w.socket.Emit("error", err)
-					return
 				}
 				return
-
 			}
 		}
 
-		data, err := w.Parser().EncodePacket(packet, w.SupportsBinary())
-		if err != nil {
-			ws_log.Debug(`Send Error "%s"`, err.Error())
-			w.socket.Emit("error", err)
+		w.mu.Lock()
+		drained := len(w.queue) == 0
+		closing := w.closing
+		if drained && !closing {
+			w.SetWritable(true)
+		}
+		w.mu.Unlock()
+
+		if closing && drained {
+			// closed by the deferred function
 			return
 		}
-		w.write(data, compress)
+		if drained && !closing {
+			w.Emit("drain")
+		}
+	}
+}
+
+// Returns the deadline of a write of the packets queued at the given time, the zero time if there is none.
+func (w *websocket) writeDeadline(queuedAt time.Time) (deadline time.Time) {
+	if timeout := w.WriteTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if maxStall := w.MaxStall(); maxStall > 0 {
+		if stall := queuedAt.Add(maxStall); deadline.IsZero() || stall.Before(deadline) {
+			deadline = stall
+		}
+	}
+	return deadline
+}
+
+// Writes the packets of a pass. The frames of the uncompressed packets are coalesced, so that they are written to the
+// connection at once, the compressed ones being written by the websocket connection in between.
+func (w *websocket) writePackets(packets []*packet.Packet, deadline time.Time) error {
+	for _, packet := range packets {
+		data, compress, err := w.encode(packet)
+		if err != nil {
+			return err
+		}
+
+		if !compress {
+			w.batch = appendFrame(w.batch, isTextFrame(data), data.Bytes())
+			w.Metrics().BytesOut(w.Name(), int64(data.Len()))
+			if len(w.batch) >= maxBatchSize {
+				if err := w.flushBatch(deadline); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := w.flushBatch(deadline); err != nil {
+			return err
+		}
+		if frame, ok := data.(*PreparedFrame); ok {
+			// shared by the sockets of a broadcast
+			w.socket.EnableWriteCompression(true)
+			w.socket.SetWriteDeadline(deadline)
+			if err := w.socket.WritePreparedMessage(frame.PreparedMessage()); err != nil {
+				return err
+			}
+			w.Metrics().BytesOut(w.Name(), int64(frame.Len()))
+		} else if err := w.write(data, true, deadline); err != nil {
+			return err
+		}
 	}
+	return w.flushBatch(deadline)
 }
 
-func (w *websocket) write(data _types.BufferInterface, compress bool) {
+// Returns the encoded packet, and whether it is to be compressed by the websocket connection.
+func (w *websocket) encode(packet *packet.Packet) (data _types.BufferInterface, compress bool, err error) {
+	if packet.Options != nil {
+		compress = packet.Options.Compress
+
+		if packet.Options.WsPreEncoded != nil {
+			data = packet.Options.WsPreEncoded
+		} else if frame, ok := packet.Options.WsPreEncodedFrame.(*PreparedFrame); ok {
+			data = frame
+		} else if w.PerMessageDeflate() == nil && packet.Options.WsPreEncodedFrame != nil {
+			data = packet.Options.WsPreEncodedFrame
+		}
+	}
+
+	if data == nil {
+		if data, err = w.Parser().EncodePacket(packet, w.SupportsBinary()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	perMessageDeflate := w.PerMessageDeflate()
+	return data, compress && perMessageDeflate != nil && data.Len() >= perMessageDeflate.Threshold, nil
+}
+
+// Writes the coalesced frames to the connection.
+func (w *websocket) flushBatch(deadline time.Time) error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	ws_log.Debug(`writing %d bytes of frames`, len(w.batch))
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	conn := w.socket.NetConn()
+	conn.SetWriteDeadline(deadline)
+	_, err := conn.Write(w.batch)
+
+	if cap(w.batch) > 2*maxBatchSize {
+		// a large packet is not to be kept around
+		w.batch = nil
+	} else {
+		w.batch = w.batch[:0]
+	}
+	return err
+}
+
+// Appends the frame of a whole, uncompressed message sent by a server, which is not masked.
+func appendFrame(b []byte, text bool, payload []byte) []byte {
+	opcode := byte(ws.BinaryMessage)
+	if text {
+		opcode = ws.TextMessage
+	}
+	// FIN
+	b = append(b, 0x80|opcode)
+
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, byte(n))
+	case n <= 0xffff:
+		b = append(b, 126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, payload...)
+}
+
+func (w *websocket) write(data _types.BufferInterface, compress bool, deadline time.Time) error {
 	if w.PerMessageDeflate() != nil {
 		if data.Len() < w.PerMessageDeflate().Threshold {
 			compress = false
@@ -183,32 +389,66 @@ func (w *websocket) write(data _types.BufferInterface, compress bool) {
 	ws_log.Debug(`writing %#v`, data)
 
 	w.socket.EnableWriteCompression(compress)
+	w.socket.SetWriteDeadline(deadline)
 	mt := ws.BinaryMessage
 	if _, ok := data.(*_types.StringBuffer); ok {
 		mt = ws.TextMessage
 	}
 	write, err := w.socket.NextWriter(mt)
 	if err != nil {
-		w.socket.Emit("error", err)
-		return
+		return err
 	}
-	defer func() {
-		if err := write.Close(); err != nil {
-			w.socket.Emit("error", err)
-			return
-		}
-	}()
-	if _, err := io.Copy(write, data); err != nil {
-		w.socket.Emit("error", err)
-		return
+	n, err := io.Copy(write, data)
+	w.Metrics().BytesOut(w.Name(), n)
+	if err != nil {
+		write.Close()
+		return err
 	}
+	return write.Close()
 }
 
-// Closes the transport.
+// Closes the transport, once the queued packets, e.g. the close packet, are written.
+//
+// A discarded transport, or one whose writer loop is writing, e.g. to a peer which stopped reading, is closed at once,
+// the write in progress failing, so that a forced close never waits for the write timeout.
 func (w *websocket) DoClose(fn e_types.Callable) {
 	ws_log.Debug(`closing`)
-	w.socket.Close()
+
+	w.mu.Lock()
+	now := w.stopped || w.writing || w.Discarded()
+	if !now {
+		w.closing = true
+		w.onClose = fn
+	}
+	w.mu.Unlock()
+
+	if now {
+		w.close(fn)
+	} else {
+		w.wake()
+	}
+}
+
+// Flags the transport as discarded. A close waiting for the writer loop, e.g. to write to a peer which stopped
+// reading, is completed at once, so that a forced close never waits for the write timeout.
+func (w *websocket) Discard() {
+	w.Transport.Discard()
+
+	w.mu.Lock()
+	closing := w.closing && w.writing
+	w.mu.Unlock()
+
+	if closing {
+		// the write in progress fails, the writer loop then closing the transport
+		w.socket.NetConn().Close()
+	}
+}
+
+// The callback runs first, so that the reason of the close is not lost to the reader loop, which fails as soon as the
+// connection is closed.
+func (w *websocket) close(fn e_types.Callable) {
 	if fn != nil {
 		fn()
 	}
+	w.socket.Close()
 }
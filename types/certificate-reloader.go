@@ -0,0 +1,202 @@
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zishang520/engine.io/v2/errors"
+	"github.com/zishang520/engine.io/v2/events"
+)
+
+// The certificate and key files of a TLS certificate.
+type CertificateFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertificateReloader serves TLS certificates which are reloaded from their files, when they change or on demand,
+// the handshakes in progress and the established connections, e.g. the websocket sessions, being left untouched.
+//
+// The certificate of a handshake is selected by its server name (SNI), the first one being the default.
+//
+//	reloader, err := types.NewCertificateReloader(
+//		types.CertificateFile{CertFile: "example.com.pem", KeyFile: "example.com.key"},
+//		types.CertificateFile{CertFile: "example.org.pem", KeyFile: "example.org.key"},
+//	)
+//	reloader.On("error", func(args ...any) { log.Println(args[0]) })
+//	reloader.Watch(time.Minute)
+//	httpServer.ListenAndServeTLSConfig(":443", reloader.TLSConfig())
+//
+// It emits "reload" when the certificates are swapped, and "error" when the watched files cannot be loaded, the
+// previous certificates being kept.
+type CertificateReloader struct {
+	events.EventEmitter
+
+	files        []CertificateFile
+	certificates atomic.Pointer[[]*tls.Certificate]
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	stop     chan struct{}
+}
+
+// Creates a reloader serving the certificates, which are loaded before returning.
+func NewCertificateReloader(files ...CertificateFile) (*CertificateReloader, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no certificate file provided").Err()
+	}
+
+	r := &CertificateReloader{
+		EventEmitter: events.New(),
+
+		files: files,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the modification times of the files, in order.
+func (r *CertificateReloader) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, 0, 2*len(r.files))
+	for _, file := range r.files {
+		for _, name := range []string{file.CertFile, file.KeyFile} {
+			info, err := os.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			modTimes = append(modTimes, info.ModTime())
+		}
+	}
+	return modTimes, nil
+}
+
+// Loads all the certificates and swaps them at once, nothing is swapped if any fails.
+func (r *CertificateReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// stated first, so that a file written while loading is reloaded by the next check
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	certificates := make([]*tls.Certificate, 0, len(r.files))
+	for _, file := range r.files {
+		certificate, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load TLS key pair from certFile=%q and keyFile=%q: %w", file.CertFile, file.KeyFile, err)
+		}
+		if certificate.Leaf == nil {
+			// parsed once, rather than on every handshake selecting a certificate
+			if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		certificates = append(certificates, &certificate)
+	}
+
+	r.certificates.Store(&certificates)
+	r.modTimes = modTimes
+	return nil
+}
+
+// Reports whether a file was modified since the certificates were loaded.
+func (r *CertificateReloader) modified() (bool, error) {
+	modTimes, err := r.stat()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reloads the certificates from their files, e.g. on SIGHUP, the previous ones being kept on error.
+func (r *CertificateReloader) Reload() error {
+	if err := r.load(); err != nil {
+		return err
+	}
+	r.Emit("reload")
+	return nil
+}
+
+// Checks the files at the given interval and reloads the certificates when one is modified, until Close is called.
+//
+// The files being possibly written one after the other, a failed reload is retried at the next check.
+func (r *CertificateReloader) Watch(interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if modified, err := r.modified(); err != nil {
+					r.Emit("error", err)
+				} else if modified {
+					if err := r.Reload(); err != nil {
+						r.Emit("error", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stops watching the files.
+func (r *CertificateReloader) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// Returns the certificate matching the server name of the handshake, the first one if none does.
+//
+// It is meant to be the tls.Config.GetCertificate function.
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := *r.certificates.Load()
+	for _, certificate := range certificates {
+		if hello.SupportsCertificate(certificate) == nil {
+			return certificate, nil
+		}
+	}
+	return certificates[0], nil
+}
+
+// Returns a TLS configuration serving the certificates of the reloader.
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
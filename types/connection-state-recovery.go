@@ -0,0 +1,19 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	// Parameters of the connection state recovery, which lets a client resume its session after a brief disconnect.
+	//
+	// To recover, the client performs a new handshake with the "recover" query parameter set to its previous sid and
+	// the "offset" query parameter set to the number of message packets it received during the session. The session
+	// gets the same sid, and the message packets sent from that offset on are replayed.
+	ConnectionStateRecovery struct {
+		// how long a disconnected session can be recovered, a zero value means 2 minutes.
+		MaxDisconnectionDuration time.Duration `json:"maxDisconnectionDuration,omitempty" mapstructure:"maxDisconnectionDuration,omitempty" msgpack:"maxDisconnectionDuration,omitempty"`
+		// how many of the last message packets are kept for the replay, a zero value means 1000.
+		MaxBufferedPackets int `json:"maxBufferedPackets,omitempty" mapstructure:"maxBufferedPackets,omitempty" msgpack:"maxBufferedPackets,omitempty"`
+	}
+)
@@ -6,6 +6,7 @@ import (
 
 	"github.com/valyala/fasthttp"
 	_types "github.com/zishang520/engine.io/v2/types"
+	"github.com/zishang520/engine.io/v2/utils"
 )
 
 type (
@@ -211,16 +212,49 @@ func (c *cors) applyHeaders() *cors {
 	for _, header := range c.headers {
 		c.ctx.ResponseHeaders.Set(header.Key, header.Value)
 	}
-	if vary := c.ctx.ResponseHeaders.Peek("Vary"); vary == "*" {
-		c.ctx.ResponseHeaders.Set("Vary", "*")
-	} else {
-		if len(c.varys) > 0 {
-			varys := parseVary(vary)
-			varys.Add(c.varys...)
-			c.ctx.ResponseHeaders.Set("Vary", strings.Join(varys.Keys(), ", "))
+	AppendVary(c.ctx.ResponseHeaders, c.varys...)
+	return c
+}
+
+// Adds the given fields to the "Vary" header, a "Vary: *" header is left untouched.
+func AppendVary(headers *utils.ParameterBag, fields ...string) {
+	if len(fields) > 0 {
+		headers.Set("Vary", appendVary(headers.Peek("Vary"), fields...))
+	}
+}
+
+// Merges "Vary" header values into another one, see appendVary.
+func mergeVary(vary string, values ...string) string {
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				vary = appendVary(vary, field)
+			}
 		}
 	}
-	return c
+	return vary
+}
+
+// Appends the fields missing from a "Vary" header value, in order, the fields being case-insensitive.
+func appendVary(vary string, fields ...string) string {
+	if vary == "*" {
+		return vary
+	}
+	varys := parseVary(strings.ToLower(vary))
+	for _, field := range fields {
+		if field == "*" {
+			return field
+		}
+		if key := strings.ToLower(field); !varys.Has(key) {
+			varys.Add(key)
+			if vary == "" {
+				vary = field
+			} else {
+				vary += ", " + field
+			}
+		}
+	}
+	return vary
 }
 
 func CorsMiddleware(options *Cors, ctx *HttpContext, next func(error)) {
@@ -11,5 +11,7 @@ type (
 
 		Req     *HttpContext   `json:"req,omitempty" mapstructure:"req,omitempty" msgpack:"req,omitempty"`
 		Context map[string]any `json:"context,omitempty" mapstructure:"context,omitempty" msgpack:"context,omitempty"`
+		// the typed error, e.g. a *engine.HandshakeError, its fields are the ones of Context.
+		Err error `json:"-" mapstructure:"-" msgpack:"-"`
 	}
 )
@@ -0,0 +1,85 @@
+package types
+
+import (
+	"compress/flate"
+	"fmt"
+
+	"github.com/andybalholm/brotli"
+	"github.com/zishang520/engine.io/v2/errors"
+)
+
+// The level used for a content-coding whose level is not set, the fastest one which compresses.
+const DefaultCompressionLevel = 1
+
+type (
+	// Compression levels of the http compression for the polling transports, one per content-coding.
+	// A nil level selects DefaultCompressionLevel, see CompressionLevel to set one.
+	HttpCompressionLevels struct {
+		// level of the "gzip" content-coding, from flate.HuffmanOnly (-2) to flate.BestCompression (9), see
+		// compress/gzip.
+		Gzip *int `json:"gzip,omitempty" mapstructure:"gzip,omitempty" msgpack:"gzip,omitempty"`
+		// level of the "deflate" content-coding, from flate.HuffmanOnly (-2) to flate.BestCompression (9), see
+		// compress/flate.
+		Deflate *int `json:"deflate,omitempty" mapstructure:"deflate,omitempty" msgpack:"deflate,omitempty"`
+		// level of the "br" content-coding, from brotli.BestSpeed (0) to brotli.BestCompression (11), see
+		// github.com/andybalholm/brotli.
+		Brotli *int `json:"brotli,omitempty" mapstructure:"brotli,omitempty" msgpack:"brotli,omitempty"`
+	}
+)
+
+// Returns a compression level, to set one of HttpCompressionLevels.
+func CompressionLevel(level int) *int {
+	return &level
+}
+
+// Reports an error if a level is out of the range of its algorithm.
+func (l *HttpCompressionLevels) Validate() error {
+	if l == nil {
+		return nil
+	}
+	for _, level := range []struct {
+		encoding string
+		level    *int
+		min, max int
+	}{
+		{"gzip", l.Gzip, flate.HuffmanOnly, flate.BestCompression},
+		{"deflate", l.Deflate, flate.HuffmanOnly, flate.BestCompression},
+		{"br", l.Brotli, brotli.BestSpeed, brotli.BestCompression},
+	} {
+		if level.level != nil && (*level.level < level.min || *level.level > level.max) {
+			return errors.New(fmt.Sprintf(`invalid compression level %d of the "%s" content-coding, want from %d to %d`, *level.level, level.encoding, level.min, level.max)).Err()
+		}
+	}
+	return nil
+}
+
+// The level of the "gzip" content-coding.
+func (l *HttpCompressionLevels) GzipLevel() int {
+	if l == nil {
+		return DefaultCompressionLevel
+	}
+	return compressionLevel(l.Gzip)
+}
+
+// The level of the "deflate" content-coding.
+func (l *HttpCompressionLevels) DeflateLevel() int {
+	if l == nil {
+		return DefaultCompressionLevel
+	}
+	return compressionLevel(l.Deflate)
+}
+
+// The level of the "br" content-coding.
+func (l *HttpCompressionLevels) BrotliLevel() int {
+	if l == nil {
+		return DefaultCompressionLevel
+	}
+	return compressionLevel(l.Brotli)
+}
+
+func compressionLevel(level *int) int {
+	if level == nil {
+		return DefaultCompressionLevel
+	}
+	return *level
+}
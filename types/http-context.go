@@ -13,65 +13,111 @@ import (
 	"github.com/zishang520/engine.io/v2/events"
 	_types "github.com/zishang520/engine.io/v2/types"
 	"github.com/zishang520/engine.io/v2/utils"
+	"github.com/zishang520/engine.io/v2/webtransport"
 )
 
 type HttpContext struct {
 	events.EventEmitter
 
-	Websocket *WebSocketConn
+	Websocket    *WebSocketConn
+	WebTransport *webtransport.Conn
 
 	Cleanup _types.Callable
 
 	requestCtx *fasthttp.RequestCtx
 
-	headers *utils.ParameterBag
-	query   *utils.ParameterBag
+	// parsed from the request on first use.
+	headers     *utils.ParameterBag
+	headersOnce sync.Once
+	query       *utils.ParameterBag
+	queryOnce   sync.Once
 
 	method      string
 	pathInfo    string
 	isHostValid bool
 
-	isDone atomic.Bool
-	done   chan _types.Void
+	// the client address resolved from the headers of the trusted proxies, if any.
+	remoteAddress atomic.Pointer[string]
 
-	statusCode      atomic.Value
+	// referenced after the request, so not to be released to the pool.
+	retained atomic.Bool
+
+	isDone  atomic.Bool
+	done    chan _types.Void
+	written bool
+
+	statusCode      atomic.Int32
 	ResponseHeaders *utils.ParameterBag
 
 	mu sync.Mutex
 }
 
+var httpContextPool = sync.Pool{
+	New: func() any {
+		return &HttpContext{EventEmitter: events.New()}
+	},
+}
+
 func NewHttpContext(ctx *fasthttp.RequestCtx) *HttpContext {
-	c := &HttpContext{
-		EventEmitter:    events.New(),
-		done:            make(chan _types.Void),
-		requestCtx:      ctx,
-		headers:         utils.NewParameterBag(nil),
-		query:           utils.NewParameterBag(nil),
-		isHostValid:     true,
-		ResponseHeaders: utils.NewParameterBag(nil),
+	c := &HttpContext{EventEmitter: events.New()}
+	c.init(ctx)
+	return c
+}
+
+// Returns a context from the pool, to be given back with ReleaseHttpContext once the request is done.
+func AcquireHttpContext(ctx *fasthttp.RequestCtx) *HttpContext {
+	c := httpContextPool.Get().(*HttpContext)
+	c.init(ctx)
+	return c
+}
+
+// Gives the context back to the pool, unless it is retained, see Retain. It must not be used afterwards.
+func ReleaseHttpContext(c *HttpContext) {
+	if c.retained.Load() {
+		return
 	}
-	ctx.Request.Header.VisitAll(func(key, value []byte) {
-		c.headers.Set(strconv.B2S(key), strconv.B2S(value))
-	})
-	ctx.QueryArgs().VisitAll(func(key, value []byte) {
-		c.query.Set(strconv.B2S(key), strconv.B2S(value))
-	})
-	ctx.Response.Header.VisitAll(func(key, value []byte) {
-		c.ResponseHeaders.Set(strconv.B2S(key), strconv.B2S(value))
-	})
 
-	go func() {
-		select {
-		case <-c.done:
-			c.Emit("close")
-		}
-	}()
+	// waits for a write in progress
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return c
+	c.Clear()
+	c.Websocket = nil
+	c.WebTransport = nil
+	c.Cleanup = nil
+	c.requestCtx = nil
+	c.headers = nil
+	c.headersOnce = sync.Once{}
+	c.query = nil
+	c.queryOnce = sync.Once{}
+	c.method = ""
+	c.pathInfo = ""
+	c.remoteAddress.Store(nil)
+	c.statusCode.Store(0)
+	c.ResponseHeaders = nil
+
+	httpContextPool.Put(c)
+}
+
+func (c *HttpContext) init(ctx *fasthttp.RequestCtx) {
+	c.requestCtx = ctx
+	c.isHostValid = true
+	c.isDone.Store(false)
+	c.done = make(chan _types.Void)
+	c.written = false
+	c.ResponseHeaders = utils.NewParameterBag(nil)
+}
+
+// Keeps the context from being released to the pool, for the contexts referenced after their request, e.g. the
+// handshake request of a socket.
+func (c *HttpContext) Retain() {
+	c.retained.Store(true)
 }
 
+// Marks the request as done, "close" being emitted before Done is closed.
 func (c *HttpContext) Flush() {
 	if c.isDone.CompareAndSwap(false, true) {
+		c.Emit("close")
 		close(c.done)
 	}
 }
@@ -85,59 +131,107 @@ func (c *HttpContext) IsDone() bool {
 }
 
 func (c *HttpContext) SetStatusCode(statusCode int) {
-	c.statusCode.Store(statusCode)
+	c.statusCode.Store(int32(statusCode))
 }
 
 func (c *HttpContext) GetStatusCode() int {
-	if v, ok := c.statusCode.Load().(int); ok {
-		return v
+	if statusCode := c.statusCode.Load(); statusCode != 0 {
+		return int(statusCode)
 	}
 	return fasthttp.StatusOK
 }
 
+// Sets the response headers and status code, a "Vary" header already set being merged with the one of the
+// ResponseHeaders. It reports false if the response was already written.
+func (c *HttpContext) writeHeader() bool {
+	if c.written || c.IsDone() {
+		return false
+	}
+	c.written = true
+
+	for k, values := range c.ResponseHeaders.All() {
+		if strings.EqualFold(k, "Vary") {
+			// the fields set before the engine, e.g. by a middleware of the router, are kept
+			values = []string{mergeVary(string(c.requestCtx.Response.Header.Peek(k)), values...)}
+		}
+		c.requestCtx.Response.Header.Del(k)
+		for _, v := range values {
+			c.requestCtx.Response.Header.Add(k, v)
+		}
+	}
+	c.requestCtx.SetStatusCode(c.GetStatusCode())
+	return true
+}
+
 func (c *HttpContext) Write(wb []byte) (int, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.IsDone() {
+	if !c.writeHeader() {
+		c.mu.Unlock()
 		return 0, errors.New("you cannot write data repeatedly").Err()
 	}
-	defer c.Flush()
+	n, err := c.requestCtx.Write(wb)
+	c.mu.Unlock()
+
+	// flushed unlocked, so that the "close" listeners may use the context
+	c.Flush()
+
+	return n, err
+}
 
-	for k, v := range c.ResponseHeaders.All() {
-		c.requestCtx.Response.Header.Set(k, v[0])
+// Sends the response headers and hands the response body over to sw, which streams it once the handler has returned.
+func (c *HttpContext) SetBodyStreamWriter(sw fasthttp.StreamWriter) error {
+	c.mu.Lock()
+	if !c.writeHeader() {
+		c.mu.Unlock()
+		return errors.New("you cannot write data repeatedly").Err()
 	}
-	c.requestCtx.SetStatusCode(c.GetStatusCode())
+	c.requestCtx.SetBodyStreamWriter(sw)
+	c.mu.Unlock()
 
-	return c.requestCtx.Write(wb)
+	c.Flush()
+
+	return nil
 }
 
 func (c *HttpContext) RequestCtx() *fasthttp.RequestCtx {
 	return c.requestCtx
 }
 
+// The parsed values are copied, the request buffers being recycled once the handler has returned.
 func (c *HttpContext) Headers() *utils.ParameterBag {
+	c.headersOnce.Do(func() {
+		c.headers = utils.NewParameterBag(make(map[string][]string, c.requestCtx.Request.Header.Len()))
+		c.requestCtx.Request.Header.VisitAll(func(key, value []byte) {
+			c.headers.Set(string(key), string(value))
+		})
+	})
 	return c.headers
 }
 
 func (c *HttpContext) Query() *utils.ParameterBag {
+	c.queryOnce.Do(func() {
+		c.query = utils.NewParameterBag(make(map[string][]string, c.requestCtx.QueryArgs().Len()))
+		c.requestCtx.QueryArgs().VisitAll(func(key, value []byte) {
+			c.query.Set(string(key), string(value))
+		})
+	})
 	return c.query
 }
 
 func (c *HttpContext) GetPathInfo() string {
 	if c.pathInfo == "" {
-		c.pathInfo = strconv.B2S(c.requestCtx.Path())
+		c.pathInfo = string(c.requestCtx.Path())
 	}
 	return c.pathInfo
 }
 
 func (c *HttpContext) Get(key string, _default ...string) string {
-	v, _ := c.query.Get(key, _default...)
+	v, _ := c.Query().Get(key, _default...)
 	return v
 }
 
 func (c *HttpContext) Gets(key string, _default ...[]string) []string {
-	v, _ := c.query.Gets(key, _default...)
+	v, _ := c.Query().Gets(key, _default...)
 	return v
 }
 
@@ -147,7 +241,7 @@ func (c *HttpContext) Method() string {
 
 func (c *HttpContext) GetMethod() string {
 	if c.method == "" {
-		c.method = strings.ToUpper(strconv.B2S(c.requestCtx.Method()))
+		c.method = strings.ToUpper(string(c.requestCtx.Method()))
 	}
 	return c.method
 }
@@ -176,9 +270,32 @@ func (c *HttpContext) GetHost() (string, error) {
 }
 
 func (c *HttpContext) UserAgent() string {
-	return c.headers.Peek("User-Agent")
+	return c.Headers().Peek("User-Agent")
 }
 
 func (c *HttpContext) Secure() bool {
 	return c.requestCtx.IsTLS()
 }
+
+// Returns the address of the peer which sent the request, which is the proxy when the client is behind one.
+func (c *HttpContext) PeerAddress() string {
+	if c.Websocket != nil && c.Websocket.Conn != nil {
+		return c.Websocket.RemoteAddr().String()
+	} else if c.WebTransport != nil {
+		return c.WebTransport.RemoteAddr().String()
+	}
+	return c.requestCtx.RemoteAddr().String()
+}
+
+// Returns the address of the client, as resolved from the headers of the trusted proxies, or the peer address.
+func (c *HttpContext) RemoteAddress() string {
+	if remoteAddress := c.remoteAddress.Load(); remoteAddress != nil {
+		return *remoteAddress
+	}
+	return c.PeerAddress()
+}
+
+// Sets the address of the client, see ResolveRemoteAddress.
+func (c *HttpContext) SetRemoteAddress(remoteAddress string) {
+	c.remoteAddress.Store(&remoteAddress)
+}
@@ -0,0 +1,347 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io/v2/errors"
+	"github.com/zishang520/engine.io/v2/utils"
+)
+
+// Adapts a Handler to net/http, so that it can be mounted in a http.ServeMux or any standard router.
+//
+// The requests are converted to a fasthttp.RequestCtx and the responses, streamed ones included, are copied back.
+// The websocket upgrades are served on the hijacked connection, which requires a HTTP/1.1 server.
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/engine.io/", types.NewHttpHandler(engine))
+func NewHttpHandler(handler Handler) http.Handler {
+	return &httpHandler{
+		handler: handler,
+		upgrades: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				handler.FastHTTP(ctx)
+				if !ctx.Hijacked() {
+					// the hijacked connection only carries the upgrade request
+					ctx.SetConnectionClose()
+				}
+			},
+			Logger: utils.Log(),
+		},
+	}
+}
+
+type httpHandler struct {
+	handler  Handler
+	upgrades *fasthttp.Server
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isHttpUpgrade(r) {
+		h.serveUpgrade(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, fasthttp.DefaultMaxRequestBodySize+1))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if len(body) > fasthttp.DefaultMaxRequestBodySize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init2(newRequestConn(r), utils.Log(), false)
+	ctx.Request.Header.SetMethod(r.Method)
+	ctx.Request.SetRequestURI(r.URL.RequestURI())
+	ctx.Request.Header.SetHost(r.Host)
+	for key, values := range r.Header {
+		for _, value := range values {
+			ctx.Request.Header.Add(key, value)
+		}
+	}
+	ctx.Request.SetBody(body)
+
+	h.handler.FastHTTP(ctx)
+
+	writeHttpResponse(w, &ctx.Response)
+}
+
+// Serves the upgrade request on the hijacked connection, the request being replayed to a fasthttp.Server.
+func (h *httpHandler) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	request := new(bytes.Buffer)
+	if err := r.Write(request); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var c net.Conn = &replayConn{Conn: conn, reader: io.MultiReader(request, rw.Reader)}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		c = &tlsReplayConn{replayConn: c.(*replayConn), tlsConn: tlsConn}
+	}
+	h.upgrades.ServeConn(c)
+}
+
+// Reports whether the request asks for a protocol upgrade, e.g. to websocket.
+func isHttpUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Copies the response, the body being streamed if it is a stream.
+func writeHttpResponse(w http.ResponseWriter, res *fasthttp.Response) {
+	header := w.Header()
+	res.Header.VisitAll(func(key, value []byte) {
+		switch k := string(key); k {
+		case fasthttp.HeaderContentLength, fasthttp.HeaderConnection, fasthttp.HeaderTransferEncoding:
+			// managed by net/http
+		default:
+			header.Add(k, string(value))
+		}
+	})
+	w.WriteHeader(res.StatusCode())
+
+	if res.IsBodyStream() {
+		res.BodyWriteTo(&flushWriter{w})
+	} else {
+		w.Write(res.Body())
+	}
+}
+
+// A writer flushing each write to the client, e.g. the events of a stream.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// The connection of a converted request, which only carries its addresses, the request being read and its response
+// written by net/http.
+type requestConn struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// A requestConn of a request received over TLS, so that fasthttp.RequestCtx.IsTLS reports it.
+type tlsRequestConn struct {
+	*requestConn
+
+	state *tls.ConnectionState
+}
+
+var errRequestConn = errors.New("the connection of a converted request is managed by net/http").Err()
+
+func newRequestConn(r *http.Request) net.Conn {
+	c := &requestConn{localAddr: &net.TCPAddr{}}
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.localAddr = localAddr
+	}
+	c.remoteAddr = parseNetAddr(c.localAddr.Network(), r.RemoteAddr)
+	if r.TLS != nil {
+		return &tlsRequestConn{requestConn: c, state: r.TLS}
+	}
+	return c
+}
+
+func (c *requestConn) Read([]byte) (int, error) {
+	return 0, errRequestConn
+}
+
+func (c *requestConn) Write([]byte) (int, error) {
+	return 0, errRequestConn
+}
+
+func (c *requestConn) Close() error {
+	return errRequestConn
+}
+
+func (c *requestConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *requestConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *requestConn) SetDeadline(time.Time) error {
+	return errRequestConn
+}
+
+func (c *requestConn) SetReadDeadline(time.Time) error {
+	return errRequestConn
+}
+
+func (c *requestConn) SetWriteDeadline(time.Time) error {
+	return errRequestConn
+}
+
+func (c *tlsRequestConn) Handshake() error {
+	return nil
+}
+
+func (c *tlsRequestConn) ConnectionState() tls.ConnectionState {
+	return *c.state
+}
+
+// An address which is not a TCP one, e.g. the one of a Unix domain socket peer, of the network of the listener.
+type stringAddr struct {
+	network string
+	address string
+}
+
+func (a *stringAddr) Network() string {
+	return a.network
+}
+
+func (a *stringAddr) String() string {
+	return a.address
+}
+
+func parseNetAddr(network string, addr string) net.Addr {
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return net.TCPAddrFromAddrPort(addrPort)
+	}
+	return &stringAddr{network: network, address: addr}
+}
+
+// A hijacked connection whose reads start with the replayed request.
+type replayConn struct {
+	net.Conn
+
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// A replayConn of a TLS connection, so that fasthttp.RequestCtx.IsTLS reports it.
+type tlsReplayConn struct {
+	*replayConn
+
+	tlsConn *tls.Conn
+}
+
+func (c *tlsReplayConn) Handshake() error {
+	return c.tlsConn.Handshake()
+}
+
+func (c *tlsReplayConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+// Adapts a net/http middleware, such as an authentication or a logging one, to the middlewares of an engine.
+//
+// The middleware is given the request and a response writer, calling the next handler resumes the request handling
+// with the response headers it set, otherwise its response is sent.
+//
+//	engine.Use(types.HttpMiddleware(func(next http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			if r.Header.Get("Authorization") == "" {
+//				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+//				return
+//			}
+//			next.ServeHTTP(w, r)
+//		})
+//	}))
+func HttpMiddleware(middleware func(http.Handler) http.Handler) func(*HttpContext, func(error)) {
+	return func(ctx *HttpContext, next func(error)) {
+		r, err := newHttpRequest(ctx)
+		if err != nil {
+			next(err)
+			return
+		}
+
+		w := &middlewareResponseWriter{header: http.Header{}, statusCode: http.StatusOK}
+		called := false
+		middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			called = true
+		})).ServeHTTP(w, r)
+
+		ctx.ResponseHeaders.With(w.header)
+		if called {
+			next(nil)
+			return
+		}
+		ctx.SetStatusCode(w.statusCode)
+		ctx.Write(w.body.Bytes())
+	}
+}
+
+// Converts the request of the context, the body being shared.
+func newHttpRequest(ctx *HttpContext) (*http.Request, error) {
+	requestCtx := ctx.RequestCtx()
+
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(requestCtx.Request.Header.Header())))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(requestCtx.Request.Body()))
+	r.RemoteAddr = ctx.PeerAddress()
+	if conn, ok := requestCtx.Conn().(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := conn.ConnectionState()
+		r.TLS = &state
+	}
+	return r.WithContext(requestCtx), nil
+}
+
+// The response writer of a middleware, whose response is sent if it does not call the next handler.
+type middlewareResponseWriter struct {
+	header     http.Header
+	statusCode int
+	written    bool
+	body       bytes.Buffer
+}
+
+func (w *middlewareResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *middlewareResponseWriter) WriteHeader(statusCode int) {
+	if !w.written {
+		w.statusCode = statusCode
+		w.written = true
+	}
+}
+
+func (w *middlewareResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.body.Write(b)
+}
@@ -1,8 +1,16 @@
 package types
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
 
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
 	"github.com/valyala/fasthttp"
 	"github.com/zishang520/engine.io/v2/errors"
 	"github.com/zishang520/engine.io/v2/events"
@@ -50,7 +58,37 @@ func (s *HttpServer) httpServer(handler Handler) *fasthttp.Server {
 	return server
 }
 
+func (s *HttpServer) webTransportServer(addr string, handler Handler) *webtransport.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	server := &webtransport.Server{
+		H3: http3.Server{Addr: addr},
+		CheckOrigin: func(*http.Request) bool {
+			// Verified by the handler
+			return true
+		},
+	}
+	server.H3.Handler = webTransportHandler(server, handler)
+
+	s.servers.Push(server)
+
+	return server
+}
+
 func (s *HttpServer) Close(fn func(error)) (err error) {
+	return s.close(func(srv *fasthttp.Server) error { return srv.Shutdown() }, fn)
+}
+
+// Closes the listeners and waits for the open connections to be idle until the context is done.
+//
+// The engines attached to the server are closed as well, call their Shutdown method first
+// to let the clients drain.
+func (s *HttpServer) Shutdown(ctx context.Context, fn func(error)) error {
+	return s.close(func(srv *fasthttp.Server) error { return srv.ShutdownWithContext(ctx) }, fn)
+}
+
+func (s *HttpServer) close(shutdown func(*fasthttp.Server) error, fn func(error)) (err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -61,7 +99,9 @@ func (s *HttpServer) Close(fn func(error)) (err error) {
 		s.servers.Range(func(server any, _ int) bool {
 			switch srv := server.(type) {
 			case *fasthttp.Server:
-				serverErr = srv.Shutdown()
+				serverErr = shutdown(srv)
+			case *webtransport.Server:
+				serverErr = srv.Close()
 			default:
 				serverErr = errors.New("unknown server type")
 			}
@@ -83,34 +123,215 @@ func (s *HttpServer) Close(fn func(error)) (err error) {
 	return err
 }
 
-func (s *HttpServer) Listen(addr string, fn _types.Callable) *fasthttp.Server {
+// Configures a listener of a HttpServer, e.g. WithProxyProtocol.
+type ListenOption func(net.Listener) net.Listener
+
+// Listens on the TCP network address, as fasthttp.Server.ListenAndServe does.
+func listenTCP(addr string) (net.Listener, error) {
+	return net.Listen("tcp4", addr)
+}
+
+// Listens on the Unix domain socket, the existing file being removed first.
+func listenUnix(addr string, mode os.FileMode) (net.Listener, error) {
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unexpected error when trying to remove unix socket file %q: %w", addr, err)
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("cannot chmod %#o for %q: %w", mode, addr, err)
+	}
+	return ln, nil
+}
+
+// Wraps the bound listener with the options and emits "listening" with its address.
+func (s *HttpServer) bind(ln net.Listener, options []ListenOption) net.Listener {
+	for _, option := range options {
+		ln = option(ln)
+	}
+	s.Emit("listening", ln.Addr())
+	return ln
+}
+
+// Serves the HTTP requests accepted by the listener, it blocks until the server is closed, in which case nil is
+// returned.
+//
+// "listening" is emitted with the address of the listener before the first connection is accepted.
+func (s *HttpServer) Serve(ln net.Listener, options ...ListenOption) error {
+	return s.httpServer(s).Serve(s.bind(ln, options))
+}
+
+// Serves the HTTPS requests accepted by the listener, see Serve.
+func (s *HttpServer) ServeTLS(ln net.Listener, certFile string, keyFile string, options ...ListenOption) error {
+	// the options see the raw connections, e.g. a PROXY protocol header precedes the TLS handshake
+	return s.httpServer(s).ServeTLS(s.bind(ln, options), certFile, keyFile)
+}
+
+// Serves the HTTPS requests accepted by the listener with the TLS configuration, see Serve.
+//
+// The configuration is cloned, the certificates may be provided by its GetCertificate function to be swapped
+// while serving, see CertificateReloader.
+func (s *HttpServer) ServeTLSConfig(ln net.Listener, config *tls.Config, options ...ListenOption) error {
 	server := s.httpServer(s)
+	server.TLSConfig = config.Clone()
+	return server.ServeTLS(s.bind(ln, options), "", "")
+}
+
+// Listens on the TCP network address and serves the HTTP requests, see Serve.
+//
+// The error of the bind is returned synchronously, e.g. when the address is in use.
+//
+//	httpServer.On("listening", func(args ...any) {
+//		log.Println("listening on", args[0].(net.Addr))
+//	})
+//	if err := httpServer.ListenAndServe("127.0.0.1:0"); err != nil {
+//		log.Fatal(err)
+//	}
+func (s *HttpServer) ListenAndServe(addr string, options ...ListenOption) error {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln, options...)
+}
+
+// Listens on the TCP network address and serves the HTTPS requests, see ListenAndServe.
+func (s *HttpServer) ListenAndServeTLS(addr string, certFile string, keyFile string, options ...ListenOption) error {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln, certFile, keyFile, options...)
+}
+
+// Listens on the TCP network address and serves the HTTPS requests with the TLS configuration, see ServeTLSConfig.
+func (s *HttpServer) ListenAndServeTLSConfig(addr string, config *tls.Config, options ...ListenOption) error {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLSConfig(ln, config, options...)
+}
+
+// Listens on the Unix domain socket and serves the HTTP requests, see ListenAndServe.
+//
+// The existing file at addr is removed first, and the socket file is given the mode.
+func (s *HttpServer) ListenAndServeUnix(addr string, mode os.FileMode, options ...ListenOption) error {
+	ln, err := listenUnix(addr, mode)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln, options...)
+}
+
+// Listens on the TCP network address and serves the HTTP requests in the background.
+//
+// The address is bound before returning, fn being called and "listening" emitted once it is. The errors, e.g. the
+// address being in use, are emitted as "error", or logged when no listener of "error" is registered: fn is not
+// called and the returned server never serves. ListenAndServe returns them instead.
+//
+//	httpServer.On("error", func(errs ...any) {
+//		log.Fatal(errs[0])
+//	})
+//	httpServer.Listen("127.0.0.1:8080", nil)
+func (s *HttpServer) Listen(addr string, fn _types.Callable, options ...ListenOption) *fasthttp.Server {
+	server := s.httpServer(s)
+	s.listen(addr, fn, options, server.Serve)
+	return server
+}
+
+// Listens on the TCP network address and serves the HTTPS requests in the background, see Listen.
+//
+// The errors are emitted as "error", or logged, see Listen. ListenAndServeTLS returns them instead.
+func (s *HttpServer) ListenTLS(addr string, certFile string, keyFile string, fn _types.Callable, options ...ListenOption) *fasthttp.Server {
+	server := s.httpServer(s)
+	s.listen(addr, fn, options, func(ln net.Listener) error {
+		return server.ServeTLS(ln, certFile, keyFile)
+	})
+	return server
+}
+
+// Listens on the TCP network address and serves the HTTPS requests with the TLS configuration in the background,
+// see Listen and ServeTLSConfig.
+//
+// The errors are emitted as "error", or logged, see Listen. ListenAndServeTLSConfig returns them instead.
+func (s *HttpServer) ListenTLSConfig(addr string, config *tls.Config, fn _types.Callable, options ...ListenOption) *fasthttp.Server {
+	server := s.httpServer(s)
+	server.TLSConfig = config.Clone()
+	s.listen(addr, fn, options, func(ln net.Listener) error {
+		return server.ServeTLS(ln, "", "")
+	})
+	return server
+}
+
+// Binds the address and serves the listener in the background, the errors being emitted as "error", see emitError.
+func (s *HttpServer) listen(addr string, fn _types.Callable, options []ListenOption, serve func(net.Listener) error) {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		s.emitError(err)
+		return
+	}
+	ln = s.bind(ln, options)
+
 	go func() {
-		if err := server.ListenAndServe(addr); err != nil {
-			panic(err)
+		if err := serve(ln); err != nil {
+			s.emitError(err)
 		}
 	}()
 
 	if fn != nil {
-		defer fn()
+		fn()
 	}
-	s.Emit("listening")
+}
 
-	return server
+// Emits an error of the listeners as "error", it is logged instead when no listener of "error" is registered, so
+// that it is never lost.
+func (s *HttpServer) emitError(err error) {
+	if s.ListenerCount("error") == 0 {
+		utils.Log().Error("http server error: %s", err.Error())
+		return
+	}
+	s.Emit("error", err)
 }
 
-func (s *HttpServer) ListenTLS(addr string, certFile string, keyFile string, fn _types.Callable) *fasthttp.Server {
-	server := s.httpServer(s)
+// Starts a companion HTTP/3 listener (UDP) accepting WebTransport sessions, the requests are dispatched
+// to the same handlers as the TCP listeners.
+//
+// The address is bound before returning, fn being called and "listening" emitted with the address once it is. The
+// errors, e.g. the certificate failing to load or the address being in use, are emitted as "error", or logged, see
+// Listen.
+func (s *HttpServer) ListenWebTransportTLS(addr string, certFile string, keyFile string, quicConfig *quic.Config, fn _types.Callable) *webtransport.Server {
+	server := s.webTransportServer(addr, s)
+	server.H3.QUICConfig = quicConfig
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		s.emitError(err)
+		return server
+	}
+	server.H3.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		s.emitError(err)
+		return server
+	}
+	s.Emit("listening", conn.LocalAddr())
+
 	go func() {
-		if err := server.ListenAndServeTLS(addr, certFile, keyFile); err != nil {
-			panic(err)
+		// closing the server does not close the connection it serves
+		defer conn.Close()
+		if err := server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			s.emitError(err)
 		}
 	}()
 
 	if fn != nil {
-		defer fn()
+		fn()
 	}
-	s.Emit("listening")
 
 	return server
 }
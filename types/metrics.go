@@ -0,0 +1,219 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+	_types "github.com/zishang520/engine.io/v2/types"
+)
+
+// The upper bounds of the buckets of the flush size histogram, in packets.
+var flushBuckets = []uint64{1, 2, 5, 10, 25, 50, 100, 250}
+
+// A counter partitioned by the value of a single label.
+type counterVec struct {
+	values _types.Map[string, *atomic.Uint64]
+}
+
+func (c *counterVec) add(label string, n uint64) {
+	value, ok := c.values.Load(label)
+	if !ok {
+		// the label may be backed by the buffers of a fasthttp.RequestCtx, which are recycled
+		value, _ = c.values.LoadOrStore(strings.Clone(label), &atomic.Uint64{})
+	}
+	value.Add(n)
+}
+
+// Returns the label values in order, so that the exposition is stable.
+func (c *counterVec) labels() []string {
+	labels := c.values.Keys()
+	sort.Strings(labels)
+	return labels
+}
+
+func (c *counterVec) get(label string) uint64 {
+	if value, ok := c.values.Load(label); ok {
+		return value.Load()
+	}
+	return 0
+}
+
+// A histogram of the flush sizes of a transport.
+type flushHistogram struct {
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64
+}
+
+// Metrics collects the counters of an engine, it is safe for concurrent use.
+//
+// The collector is a types.Handler which writes the Prometheus text exposition format, so that it can
+// be mounted on a ServeMux, e.g. httpServer.Handle("/metrics", engine.Metrics()).
+// The recording methods of a nil *Metrics are no-op.
+type Metrics struct {
+	clients func() uint64
+
+	handshakes       counterVec
+	connectionErrors counterVec
+	upgrades         counterVec
+	disconnections   counterVec
+	receivedBytes    counterVec
+	sentBytes        counterVec
+
+	flushes _types.Map[string, *flushHistogram]
+}
+
+// Creates a collector, the clients function reports the number of open clients.
+func NewMetrics(clients func() uint64) *Metrics {
+	return &Metrics{clients: clients}
+}
+
+// Records a successful handshake on the given transport.
+func (m *Metrics) Handshake(transport string) {
+	if m != nil {
+		m.handshakes.add(transport, 1)
+	}
+}
+
+// Records a connection error by its code.
+func (m *Metrics) ConnectionError(code int) {
+	if m != nil {
+		m.connectionErrors.add(fmt.Sprint(code), 1)
+	}
+}
+
+// Records an upgrade to the given transport.
+func (m *Metrics) Upgrade(transport string) {
+	if m != nil {
+		m.upgrades.add(transport, 1)
+	}
+}
+
+// Records a closed socket by its close reason, e.g. "ping timeout".
+func (m *Metrics) Disconnection(reason string) {
+	if m != nil {
+		m.disconnections.add(reason, 1)
+	}
+}
+
+// Records bytes received by the given transport.
+func (m *Metrics) BytesIn(transport string, n int64) {
+	if m != nil && n > 0 {
+		m.receivedBytes.add(transport, uint64(n))
+	}
+}
+
+// Records bytes sent by the given transport.
+func (m *Metrics) BytesOut(transport string, n int64) {
+	if m != nil && n > 0 {
+		m.sentBytes.add(transport, uint64(n))
+	}
+}
+
+// Records a flush of the given number of packets to the given transport.
+func (m *Metrics) Flush(transport string, packets int) {
+	if m == nil {
+		return
+	}
+	h, ok := m.flushes.Load(transport)
+	if !ok {
+		h, _ = m.flushes.LoadOrStore(strings.Clone(transport), &flushHistogram{buckets: make([]atomic.Uint64, len(flushBuckets))})
+	}
+	// counted first, so that a bucket never exceeds the count while exposed
+	h.count.Add(1)
+	h.sum.Add(uint64(packets))
+	for i, bound := range flushBuckets {
+		if uint64(packets) <= bound {
+			h.buckets[i].Add(1)
+		}
+	}
+}
+
+// Returns the number of handshakes on the given transport.
+func (m *Metrics) Handshakes(transport string) uint64 {
+	return m.handshakes.get(transport)
+}
+
+// Returns the number of connection errors with the given code.
+func (m *Metrics) ConnectionErrors(code int) uint64 {
+	return m.connectionErrors.get(fmt.Sprint(code))
+}
+
+// Returns the number of upgrades to the given transport.
+func (m *Metrics) Upgrades(transport string) uint64 {
+	return m.upgrades.get(transport)
+}
+
+// Returns the number of sockets closed for the given reason.
+func (m *Metrics) Disconnections(reason string) uint64 {
+	return m.disconnections.get(reason)
+}
+
+// Returns the number of bytes received by the given transport.
+func (m *Metrics) ReceivedBytes(transport string) uint64 {
+	return m.receivedBytes.get(transport)
+}
+
+// Returns the number of bytes sent by the given transport.
+func (m *Metrics) SentBytes(transport string) uint64 {
+	return m.sentBytes.get(transport)
+}
+
+// Writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) FastHTTP(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetBody(m.Bytes())
+}
+
+// Returns the metrics in the Prometheus text exposition format.
+func (m *Metrics) Bytes() []byte {
+	b := new(bytes.Buffer)
+
+	clients := uint64(0)
+	if m.clients != nil {
+		clients = m.clients()
+	}
+	fmt.Fprintf(b, "# HELP engineio_clients The number of open clients.\n# TYPE engineio_clients gauge\nengineio_clients %d\n", clients)
+
+	writeCounterVec(b, "engineio_handshakes_total", "The number of successful handshakes.", "transport", &m.handshakes)
+	writeCounterVec(b, "engineio_connection_errors_total", "The number of rejected connections.", "code", &m.connectionErrors)
+	writeCounterVec(b, "engineio_upgrades_total", "The number of transport upgrades.", "transport", &m.upgrades)
+	writeCounterVec(b, "engineio_disconnections_total", "The number of closed sockets.", "reason", &m.disconnections)
+	writeCounterVec(b, "engineio_received_bytes_total", "The number of bytes received.", "transport", &m.receivedBytes)
+	writeCounterVec(b, "engineio_sent_bytes_total", "The number of bytes sent.", "transport", &m.sentBytes)
+
+	b.WriteString("# HELP engineio_flush_packets The number of packets per flush.\n# TYPE engineio_flush_packets histogram\n")
+	transports := m.flushes.Keys()
+	sort.Strings(transports)
+	for _, transport := range transports {
+		h, _ := m.flushes.Load(transport)
+		label := escapeLabelValue(transport)
+		for i, bound := range flushBuckets {
+			fmt.Fprintf(b, "engineio_flush_packets_bucket{transport=\"%s\",le=\"%d\"} %d\n", label, bound, h.buckets[i].Load())
+		}
+		count := h.count.Load()
+		fmt.Fprintf(b, "engineio_flush_packets_bucket{transport=\"%s\",le=\"+Inf\"} %d\n", label, count)
+		fmt.Fprintf(b, "engineio_flush_packets_sum{transport=\"%s\"} %d\n", label, h.sum.Load())
+		fmt.Fprintf(b, "engineio_flush_packets_count{transport=\"%s\"} %d\n", label, count)
+	}
+
+	return b.Bytes()
+}
+
+func writeCounterVec(b *bytes.Buffer, name, help, label string, c *counterVec) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, value := range c.labels() {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, escapeLabelValue(value), c.get(value))
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
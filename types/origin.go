@@ -0,0 +1,73 @@
+package types
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Decides whether a request from the given origin is allowed.
+type OriginFunc func(origin string, ctx *HttpContext) bool
+
+// Reports whether the origin matches the allowed origins, which are one of, or a slice ([]string or []any) of:
+//   - a string, matched exactly, in which "*" matches any part of the host or port, e.g. "https://*.example.com",
+//     a single "*" matching any origin
+//   - a *regexp.Regexp
+//   - an OriginFunc, or a func(string, *HttpContext) bool
+//   - a bool, allowing or rejecting any origin
+func IsOriginAllowed(origin string, allowedOrigins any, ctx *HttpContext) bool {
+	switch v := allowedOrigins.(type) {
+	case []any:
+		for _, value := range v {
+			if IsOriginAllowed(origin, value, ctx) {
+				return true
+			}
+		}
+	case []string:
+		for _, value := range v {
+			if IsOriginAllowed(origin, value, ctx) {
+				return true
+			}
+		}
+	case string:
+		if v == "*" || v == origin {
+			return true
+		}
+		return strings.Contains(v, "*") && matchWildcard(v, origin)
+	case *regexp.Regexp:
+		return v.MatchString(origin)
+	case OriginFunc:
+		return v(origin, ctx)
+	case func(string, *HttpContext) bool:
+		return v(origin, ctx)
+	case bool:
+		return v
+	}
+	return false
+}
+
+// Matches the origin against a pattern in which "*" stands for a non-empty run of characters other than "/" and ":",
+// so that a wildcard never spans the scheme, the host and the port.
+func matchWildcard(pattern, origin string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(origin, parts[0]) {
+		return false
+	}
+	origin = origin[len(parts[0]):]
+
+	for i, part := range parts[1:] {
+		var n int
+		if last := i == len(parts)-2; last {
+			if !strings.HasSuffix(origin, part) {
+				return false
+			}
+			n = len(origin) - len(part)
+		} else if n = strings.Index(origin, part); n < 0 || part == "" {
+			return false
+		}
+		if wildcard := origin[:n]; wildcard == "" || strings.ContainsAny(wildcard, "/:") {
+			return false
+		}
+		origin = origin[n+len(part):]
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zishang520/engine.io/v2/errors"
+)
+
+// The signature which starts a PROXY protocol v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// The maximum length of a PROXY protocol v1 header, CRLF included.
+	proxyProtocolV1MaxLength = 107
+
+	// How long a connection is given to send its header by default.
+	defaultProxyProtocolTimeout = 10 * time.Second
+)
+
+var (
+	ErrProxyProtocolHeader        = errors.New("invalid PROXY protocol header").Err()
+	ErrProxyProtocolHeaderTimeout = errors.New("PROXY protocol header timeout").Err()
+)
+
+// The HAProxy PROXY protocol, v1 and v2, spoken by the load balancers in front of the server.
+//
+// Each connection accepted from an allowed upstream must start with a header, whose source address becomes the
+// remote address of the connection, and so of the requests and the websocket connections it carries. The connections
+// of the other peers are served as is.
+//
+// The header is read with the request, so that the limits applied when accepting the connections, e.g. the
+// MaxConnsPerIP of fasthttp, see the addresses of the load balancers instead.
+//
+//	httpServer.Listen(":8080", nil, types.WithProxyProtocol(&types.ProxyProtocol{
+//		Upstreams: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+//	}))
+type ProxyProtocol struct {
+	// the networks of the load balancers, any peer is expected to send a header if empty.
+	Upstreams []netip.Prefix
+	// how long a connection is given to send its header, 10 seconds if zero.
+	Timeout time.Duration
+}
+
+// Wraps the listener so that the connections accepted from the upstreams are expected to start with a PROXY protocol
+// header.
+func NewProxyProtocolListener(ln net.Listener, config *ProxyProtocol) net.Listener {
+	if config == nil {
+		config = &ProxyProtocol{}
+	}
+	return &proxyProtocolListener{Listener: ln, config: config}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+
+	config *ProxyProtocol
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if upstreams := l.config.Upstreams; len(upstreams) > 0 {
+		addr, ok := parseAddress(conn.RemoteAddr().String())
+		if !ok || !isTrusted(addr, upstreams) {
+			return conn, nil
+		}
+	}
+
+	timeout := l.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultProxyProtocolTimeout
+	}
+	// the header is read by the first use of the connection, so that a slow peer never blocks the accepting loop
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// A connection whose remote and local addresses are the ones of its PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	read       atomic.Bool
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// Reads the header once, the connection is closed if it does not arrive in time.
+func (c *proxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		timer := time.AfterFunc(c.timeout, func() { c.Conn.Close() })
+		c.err = c.parseHeader()
+		if !timer.Stop() {
+			c.err = ErrProxyProtocolHeaderTimeout
+		}
+		if c.err != nil {
+			c.Conn.Close()
+		}
+		c.read.Store(true)
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) parseHeader() error {
+	signature, err := c.reader.Peek(len(proxyProtocolSignature))
+	if bytes.Equal(signature, proxyProtocolSignature) {
+		return c.parseV2()
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return c.parseV1()
+	}
+	if err != nil {
+		return err
+	}
+	return ErrProxyProtocolHeader
+}
+
+// Parses a human-readable header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func (c *proxyProtocolConn) parseV1() error {
+	line := make([]byte, 0, proxyProtocolV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return ErrProxyProtocolHeader
+		}
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the addresses are the ones of the connection
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrProxyProtocolHeader
+	}
+
+	src, err := parseProxyAddrPort(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddrPort(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	if src.Addr().Is4() != (fields[1] == "TCP4") || dst.Addr().Is4() != (fields[1] == "TCP4") {
+		return ErrProxyProtocolHeader
+	}
+
+	c.remoteAddr, c.localAddr = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+	return nil
+}
+
+// Parses a binary header, the TLVs which may follow the addresses being skipped.
+func (c *proxyProtocolConn) parseV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return ErrProxyProtocolHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. a health check of the load balancer
+		return nil
+	case 0x1: // PROXY
+	default:
+		return ErrProxyProtocolHeader
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX, the addresses are the ones of the connection
+		return nil
+	}
+	if header[13]&0x0f != 0x1 {
+		// not a stream
+		return nil
+	}
+	if len(payload) < 2*size+4 {
+		return ErrProxyProtocolHeader
+	}
+
+	src, _ := netip.AddrFromSlice(payload[:size])
+	dst, _ := netip.AddrFromSlice(payload[size : 2*size])
+	c.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[2*size:])))
+	c.localAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2*size+2:])))
+	return nil
+}
+
+func parseProxyAddrPort(addr string, port string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, ErrProxyProtocolHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, ErrProxyProtocolHeader
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// Returns the source address of the header once it has been read by the first Read, the address of the peer until
+// then, so that the accepting loop, e.g. the one of fasthttp limiting the connections per IP, never waits for it.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.read.Load() && c.err == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Returns the destination address of the header once it has been read, see RemoteAddr.
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.read.Load() && c.err == nil && c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Expects the connections of the upstreams to start with a PROXY protocol header, see ProxyProtocol.
+func WithProxyProtocol(config *ProxyProtocol) ListenOption {
+	return func(ln net.Listener) net.Listener {
+		return NewProxyProtocolListener(ln, config)
+	}
+}
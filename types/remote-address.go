@@ -0,0 +1,97 @@
+package types
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/savsgio/gotils/strconv"
+)
+
+// Resolves the address of the client of a request which went through trusted proxies.
+//
+// The headers are only read when the peer is a trusted proxy. The forwarding chain, taken from the RFC 7239
+// "Forwarded" header, else from the "X-Forwarded-For" header, else from the "X-Real-IP" header, is walked from the
+// peer backwards, and the first address which is not a trusted proxy is the client one. The peer address is returned
+// when it is not trusted or no header is set.
+func ResolveRemoteAddress(ctx *HttpContext, trustedProxies []netip.Prefix) string {
+	peer := ctx.PeerAddress()
+	if len(trustedProxies) == 0 {
+		return peer
+	}
+
+	addr, ok := parseAddress(peer)
+	if !ok || !isTrusted(addr, trustedProxies) {
+		return peer
+	}
+
+	chain := forwardedChain(ctx)
+	if len(chain) == 0 {
+		return peer
+	}
+
+	// the closest hop is the last one
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, ok := parseAddress(chain[i])
+		if !ok {
+			// an obfuscated or invalid hop, nothing before it can be trusted
+			break
+		}
+		addr = hop
+		if !isTrusted(hop, trustedProxies) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// Returns the addresses of the forwarding chain, the client first.
+func forwardedChain(ctx *HttpContext) (chain []string) {
+	header := &ctx.RequestCtx().Request.Header
+
+	if values := header.PeekAll("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(strconv.B2S(value), ",") {
+				for _, pair := range strings.Split(element, ";") {
+					if key, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(key, "for") {
+						chain = append(chain, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+		return chain
+	}
+
+	if values := header.PeekAll("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			for _, hop := range strings.Split(strconv.B2S(value), ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+		return chain
+	}
+
+	if value := header.Peek("X-Real-IP"); len(value) > 0 {
+		chain = append(chain, strings.TrimSpace(strconv.B2S(value)))
+	}
+	return chain
+}
+
+// Parses an address, with or without a port, IPv6 addresses being possibly enclosed in brackets.
+func parseAddress(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func isTrusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	// Statistics of a socket, the sizes being the ones of the packet data.
+	SocketStats struct {
+		PacketsSent     uint64 `json:"packetsSent" mapstructure:"packetsSent" msgpack:"packetsSent"`
+		PacketsReceived uint64 `json:"packetsReceived" mapstructure:"packetsReceived" msgpack:"packetsReceived"`
+		BytesSent       uint64 `json:"bytesSent" mapstructure:"bytesSent" msgpack:"bytesSent"`
+		BytesReceived   uint64 `json:"bytesReceived" mapstructure:"bytesReceived" msgpack:"bytesReceived"`
+		// when a packet was last sent or received.
+		LastActivity time.Time `json:"lastActivity" mapstructure:"lastActivity" msgpack:"lastActivity"`
+		// when the socket was upgraded, the zero time if it was not.
+		UpgradedAt time.Time `json:"upgradedAt,omitempty" mapstructure:"upgradedAt,omitempty" msgpack:"upgradedAt,omitempty"`
+		// the transports used by the socket, in order.
+		Transports []TransportUsage `json:"transports" mapstructure:"transports" msgpack:"transports"`
+		// the smoothed round-trip time of the heartbeats, from the server ping to the client pong, zero until the first
+		// one completes.
+		//
+		// In protocol v3, whose heartbeats are sent by the client, it runs from the client ping being received to the
+		// server pong being flushed to the transport, e.g. until the next poll.
+		RTT time.Duration `json:"rtt" mapstructure:"rtt" msgpack:"rtt"`
+	}
+
+	// A transport used by a socket.
+	TransportUsage struct {
+		Name  string    `json:"name" mapstructure:"name" msgpack:"name"`
+		Since time.Time `json:"since" mapstructure:"since" msgpack:"since"`
+	}
+)
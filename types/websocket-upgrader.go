@@ -0,0 +1,29 @@
+package types
+
+import (
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+type (
+	// Settings of the upgrades of the requests to websocket connections.
+	WebSocketUpgrader struct {
+		// the size of the read buffer of each connection, 1024 bytes if zero.
+		ReadBufferSize int `json:"readBufferSize,omitempty" mapstructure:"readBufferSize,omitempty" msgpack:"readBufferSize,omitempty"`
+		// the size of the write buffer of each connection, 1024 bytes if zero.
+		WriteBufferSize int `json:"writeBufferSize,omitempty" mapstructure:"writeBufferSize,omitempty" msgpack:"writeBufferSize,omitempty"`
+		// a pool of write buffers shared by the connections, which only hold one while writing a message. Sharing it
+		// saves memory when there are many connections writing rarely. Each connection holds its own buffer if nil.
+		WriteBufferPool websocket.BufferPool `json:"-" mapstructure:"-" msgpack:"-"`
+		// the subprotocols supported by the server, in order of preference. The first of them the client lists in its
+		// "Sec-WebSocket-Protocol" header is selected, see WebSocketConn.Subprotocol. None is selected if empty.
+		Subprotocols []string `json:"subprotocols,omitempty" mapstructure:"subprotocols,omitempty" msgpack:"subprotocols,omitempty"`
+		// how long writing the handshake response may take, no limit if zero. A write timeout of the HTTP server
+		// takes precedence.
+		HandshakeTimeout time.Duration `json:"handshakeTimeout,omitempty" mapstructure:"handshakeTimeout,omitempty" msgpack:"handshakeTimeout,omitempty"`
+		// the flate level of the messages compressed with the permessage-deflate extension, from -2 (Huffman only) to 9
+		// (best compression), 1 (best speed) if zero.
+		CompressionLevel int `json:"compressionLevel,omitempty" mapstructure:"compressionLevel,omitempty" msgpack:"compressionLevel,omitempty"`
+	}
+)
@@ -0,0 +1,123 @@
+package types
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/quic-go/webtransport-go"
+	"github.com/valyala/fasthttp"
+	"github.com/zishang520/engine.io/v2/errors"
+	webtrans "github.com/zishang520/engine.io/v2/webtransport"
+)
+
+// The user value key under which a *WebTransportRequest is stored on the fasthttp.RequestCtx.
+const webTransportRequestKey = "engine.io/webtransport"
+
+// WebTransportRequest is a WebTransport session request (extended CONNECT) received by the HTTP/3 listener
+// of a HttpServer, it is handed to the fasthttp handlers through the fasthttp.RequestCtx.
+type WebTransportRequest struct {
+	server   *webtransport.Server
+	response http.ResponseWriter
+	request  *http.Request
+
+	upgraded atomic.Bool
+}
+
+// Returns the underlying HTTP/3 request.
+func (r *WebTransportRequest) Request() *http.Request {
+	return r.request
+}
+
+// Reports whether the session request has been accepted.
+func (r *WebTransportRequest) Upgraded() bool {
+	return r.upgraded.Load()
+}
+
+// Accepts the session request, this can only be done once.
+func (r *WebTransportRequest) Upgrade() (*webtransport.Session, error) {
+	if !r.upgraded.CompareAndSwap(false, true) {
+		return nil, errors.New("webtransport: session request already upgraded").Err()
+	}
+	return r.server.Upgrade(r.response, r.request)
+}
+
+// Returns the WebTransport session request carried by the fasthttp.RequestCtx, if any.
+func WebTransportRequestFrom(ctx *fasthttp.RequestCtx) *WebTransportRequest {
+	r, _ := ctx.UserValue(webTransportRequestKey).(*WebTransportRequest)
+	return r
+}
+
+// Returns true if the client requested to establish a WebTransport session.
+func IsWebTransportUpgrade(ctx *fasthttp.RequestCtx) bool {
+	return WebTransportRequestFrom(ctx) != nil
+}
+
+// Hop-by-hop headers which are not allowed in HTTP/3 responses.
+var h3ForbiddenHeaders = map[string]bool{
+	fasthttp.HeaderConnection:       true,
+	fasthttp.HeaderKeepAlive:        true,
+	fasthttp.HeaderTransferEncoding: true,
+	fasthttp.HeaderUpgrade:          true,
+	fasthttp.HeaderContentLength:    true,
+}
+
+// Adapts the HTTP/3 requests of a webtransport.Server to the fasthttp handler.
+func webTransportHandler(server *webtransport.Server, handler Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(r.Method)
+		req.Header.SetProtocol(r.Proto)
+		req.SetRequestURI(r.URL.RequestURI())
+		req.Header.SetHost(r.Host)
+		for key, values := range r.Header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+
+		var wtr *WebTransportRequest
+		if webtrans.IsWebTransportUpgrade(r) {
+			// the request stream becomes the session stream, it has no body.
+			wtr = &WebTransportRequest{server: server, response: w, request: r}
+		} else if r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, fasthttp.DefaultMaxRequestBodySize+1))
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if len(body) > fasthttp.DefaultMaxRequestBodySize {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			req.SetBodyRaw(body)
+		}
+
+		var remoteAddr net.Addr
+		if addr, err := net.ResolveUDPAddr("udp", r.RemoteAddr); err == nil {
+			remoteAddr = addr
+		}
+
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, remoteAddr, nil)
+		if wtr != nil {
+			ctx.SetUserValue(webTransportRequestKey, wtr)
+		}
+
+		handler.FastHTTP(ctx)
+
+		if wtr != nil && wtr.Upgraded() {
+			// the response has been written by the upgrade
+			return
+		}
+
+		ctx.Response.Header.VisitAll(func(key, value []byte) {
+			if k := string(key); !h3ForbiddenHeaders[k] {
+				w.Header().Add(k, string(value))
+			}
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		w.Write(ctx.Response.Body())
+	})
+}
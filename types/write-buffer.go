@@ -0,0 +1,34 @@
+package types
+
+import (
+	"time"
+)
+
+// What happens to a message packet sent while the write buffer of a socket is full.
+type WriteBufferPolicy string
+
+const (
+	// The oldest buffered message packets are dropped to make room for the new one.
+	WriteBufferDropOldest WriteBufferPolicy = "drop-oldest"
+	// The new message packet is dropped.
+	WriteBufferDropNewest WriteBufferPolicy = "drop-newest"
+	// The socket is closed with the "write buffer full" reason.
+	WriteBufferClose WriteBufferPolicy = "close"
+	// The sender waits for room in the buffer, the new message packet is dropped once the timeout expires.
+	WriteBufferBlock WriteBufferPolicy = "block"
+)
+
+type (
+	// Limits of the packets buffered by a socket while its transport is not writable.
+	// The limits apply to the message packets only, a zero value means no limit.
+	WriteBuffer struct {
+		// how many packets can be buffered.
+		MaxPackets int `json:"maxPackets,omitempty" mapstructure:"maxPackets,omitempty" msgpack:"maxPackets,omitempty"`
+		// how many bytes of packet data can be buffered.
+		MaxBytes int64 `json:"maxBytes,omitempty" mapstructure:"maxBytes,omitempty" msgpack:"maxBytes,omitempty"`
+		// what happens once a limit is reached, defaults to WriteBufferDropNewest.
+		Policy WriteBufferPolicy `json:"policy,omitempty" mapstructure:"policy,omitempty" msgpack:"policy,omitempty"`
+		// how long a sender waits with the WriteBufferBlock policy, a zero value means 5 seconds.
+		Timeout time.Duration `json:"timeout,omitempty" mapstructure:"timeout,omitempty" msgpack:"timeout,omitempty"`
+	}
+)